@@ -0,0 +1,187 @@
+package godl
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+// AccessError is returned if the destination is denied by the access list
+// of the godl server.
+type AccessError struct {
+	Host string
+}
+
+func (e *AccessError) Error() string {
+	return "destination is not allowed: " + e.Host
+}
+
+func isAccessError(err error) bool {
+	var ae *AccessError
+	return errors.As(err, &ae)
+}
+
+// accessList decides the destinations a godl server can connect to. The
+// loopback, link-local and private addresses are denied unless they are
+// allowed explicitly. If any allow rule is given, only the destinations
+// matched are allowed.
+type accessList struct {
+	allowHosts []string
+	allowNets  []*net.IPNet
+	denyHosts  []string
+	denyNets   []*net.IPNet
+}
+
+func newAccessList(allow, deny []string) (*accessList, error) {
+	a := new(accessList)
+	var err error
+	if a.allowHosts, a.allowNets, err = parseAccessRules(allow); err != nil {
+		return nil, err
+	}
+	if a.denyHosts, a.denyNets, err = parseAccessRules(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// rules are CIDRs, IPs, hosts, or domains like ".example.com" or
+// "*.example.com" which match the subdomains and example.com itself.
+func parseAccessRules(rules []string) (hosts []string, nets []*net.IPNet, err error) {
+	for _, r := range rules {
+		r = strings.ToLower(strings.TrimSpace(r))
+		switch {
+		case r == "":
+		case strings.Contains(r, "/"):
+			_, n, err := net.ParseCIDR(r)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, n)
+		case net.ParseIP(r) != nil:
+			ip := net.ParseIP(r)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			hosts = append(hosts, strings.TrimPrefix(r, "*"))
+		}
+	}
+	return hosts, nets, nil
+}
+
+func matchHost(rules []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, r := range rules {
+		if r == host {
+			return true
+		}
+		if strings.HasPrefix(r, ".") && (strings.HasSuffix(host, r) || host == r[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchNet(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the ranges not covered by the net.IP methods
+var internalNets = mustParseCIDRs(
+	"0.0.0.0/8",      // this network
+	"100.64.0.0/10",  // shared address space, CGNAT
+	"192.0.0.0/24",   // IETF protocol assignments
+	"198.18.0.0/15",  // benchmarking
+	"240.0.0.0/4",    // reserved, and the broadcast
+	"fec0::/10",      // deprecated site-local
+	"64:ff9b:1::/48", // local-use NAT64
+)
+
+// the IPv6 ranges embedding an IPv4 address in the last 4 bytes, the
+// IPv4-mapped addresses are converted by To4
+var embeddedIPv4Nets = mustParseCIDRs(
+	"::/96",        // IPv4-compatible
+	"64:ff9b::/96", // NAT64
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+func isInternalIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else if len(ip) == net.IPv6len && matchNet(embeddedIPv4Nets, ip) &&
+		!ip.Equal(net.IPv6unspecified) && !ip.Equal(net.IPv6loopback) {
+		return isInternalIP(net.IP(ip[12:]))
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || matchNet(internalNets, ip)
+}
+
+func (a *accessList) checkHost(host string) error {
+	if matchHost(a.denyHosts, host) {
+		return &AccessError{host}
+	}
+	return nil
+}
+
+func (a *accessList) checkIP(host string, ip net.IP) error {
+	if matchNet(a.denyNets, ip) {
+		return &AccessError{host}
+	}
+	if matchNet(a.allowNets, ip) || matchHost(a.allowHosts, host) {
+		return nil
+	}
+	if len(a.allowHosts)+len(a.allowNets) > 0 || isInternalIP(ip) {
+		return &AccessError{host}
+	}
+	return nil
+}
+
+// dialContext checks the resolved addresses instead of the url, so the
+// redirects and the dns rebinding are covered too.
+func (a *accessList) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.checkHost(host); err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	err = &AccessError{host}
+	for _, ip := range ips {
+		if e := a.checkIP(host, ip.IP); e != nil {
+			continue
+		}
+		conn, e := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if e == nil {
+			return conn, nil
+		}
+		err = e
+	}
+	return nil, err
+}
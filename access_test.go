@@ -0,0 +1,83 @@
+package godl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIsInternalIP(t *testing.T) {
+	for _, c := range []struct {
+		ip       string
+		internal bool
+	}{
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"169.254.169.254", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"198.18.0.1", true},
+		{"255.255.255.255", true},
+		{"::1", true},
+		{"::", true},
+		{"fc00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:169.254.169.254", true},
+		{"::ffff:100.64.0.1", true},
+		{"::127.0.0.1", true},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b:1::1", true},
+
+		{"8.8.8.8", false},
+		{"100.63.255.255", false},
+		{"100.128.0.1", false},
+		{"::ffff:8.8.8.8", false},
+		{"64:ff9b::808:808", false},
+		{"2001:4860:4860::8888", false},
+	} {
+		ip := net.ParseIP(c.ip)
+		if ip == nil {
+			t.Fatal("invalid ip:", c.ip)
+		}
+		if isInternalIP(ip) != c.internal {
+			t.Fatal(c.ip, "expect internal:", c.internal)
+		}
+	}
+}
+
+func TestAccessListCheckIP(t *testing.T) {
+	a, err := newAccessList([]string{"100.64.0.0/10"}, []string{"100.64.1.0/24", ".evil.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		host string
+		ip   string
+		ok   bool
+	}{
+		{"a.com", "100.64.0.1", true},
+		{"a.com", "::ffff:100.64.0.1", true},
+		{"a.com", "100.64.1.1", false},
+		{"a.com", "::ffff:100.64.1.1", false},
+		// only the allowed are accepted once any is given
+		{"a.com", "8.8.8.8", false},
+	} {
+		err := a.checkIP(c.host, net.ParseIP(c.ip))
+		if (err == nil) != c.ok {
+			t.Fatal(c.host, c.ip, "expect ok:", c.ok, "got", err)
+		}
+	}
+	if err := a.checkHost("www.evil.com"); !isAccessError(err) {
+		t.Fatal("the denied host is accepted:", err)
+	}
+
+	a, _ = newAccessList(nil, nil)
+	if err := a.checkIP("a.com", net.ParseIP("::ffff:100.64.0.1")); err == nil {
+		t.Fatal("the shared address is accepted")
+	}
+	if err := a.checkIP("a.com", net.ParseIP("8.8.8.8")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,207 @@
+package godl
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/logex.v1"
+)
+
+// BindApi registers the json api of the manager into mux:
+//
+//	GET    /jobs             list jobs
+//	POST   /jobs             create a job
+//	GET    /jobs/events      progress of jobs as server-sent events
+//	GET    /jobs/<id>        status of a job with its block map
+//	DELETE /jobs/<id>        cancel and remove a job
+//	POST   /jobs/<id>/pause  pause a job
+//	POST   /jobs/<id>/resume resume a job
+//
+// If secret is not empty, the requests must carry it by "Authorization:
+// Bearer <secret>", or by ?token=<secret> for the EventSource.
+func BindApi(mux *http.ServeMux, m *Manager, secret string) {
+	a := &api{m, secret}
+	mux.HandleFunc("/jobs", a.auth(a.jobsHandler))
+	mux.HandleFunc("/jobs/", a.auth(a.jobHandler))
+}
+
+type api struct {
+	m      *Manager
+	secret string
+}
+
+func (a *api) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a.secret != "" {
+			token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if t := req.URL.Query().Get("token"); t != "" {
+				token = t
+			}
+			if subtle.ConstantTimeCompare([]byte(token), []byte(a.secret)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJsonError(w, 401, logex.NewError("unauthorized"))
+				return
+			}
+		}
+		h(w, req)
+	}
+}
+
+// the body of POST /jobs
+type ApiJobRequest struct {
+	JobSpec
+	// same as Urls[0]
+	Url string `json:"url,omitempty"`
+	// output path, overwrites Dir and Name
+	Out string `json:"out,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJson(w http.ResponseWriter, code int, obj interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		logex.Error(err)
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, code int, err error) {
+	if err == ErrJobNotFound {
+		code = http.StatusNotFound
+	}
+	writeJson(w, code, &apiError{err.Error()})
+}
+
+func (a *api) jobsHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		writeJson(w, 200, a.m.Jobs())
+	case "POST":
+		var r ApiJobRequest
+		if err := json.NewDecoder(req.Body).Decode(&r); err != nil {
+			writeJsonError(w, 400, err)
+			return
+		}
+		if r.Url != "" {
+			r.Urls = append([]string{r.Url}, r.Urls...)
+		}
+		if r.Out != "" {
+			// relative to the dir of manager
+			r.Dir, r.Name = filepath.Split(r.Out)
+		}
+		job, err := a.m.Add(&r.JobSpec)
+		if err != nil {
+			writeJsonError(w, 400, err)
+			return
+		}
+		writeJson(w, 201, job)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJsonError(w, 405, logex.NewError("method not allowed"))
+	}
+}
+
+func (a *api) jobHandler(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/jobs/"), "/")
+	if path == "events" {
+		a.eventsHandler(w, req)
+		return
+	}
+	id, action := path, ""
+	if idx := strings.Index(path, "/"); idx > 0 {
+		id, action = path[:idx], path[idx+1:]
+	}
+
+	var err error
+	switch {
+	case action == "" && req.Method == "GET":
+	case action == "" && req.Method == "DELETE":
+		err = a.m.Remove(id)
+		if err == nil {
+			w.WriteHeader(204)
+			return
+		}
+	case action == "pause" && req.Method == "POST":
+		err = a.m.Pause(id)
+	case action == "resume" && req.Method == "POST":
+		err = a.m.Resume(id)
+	case action == "pause" || action == "resume":
+		w.Header().Set("Allow", "POST")
+		writeJsonError(w, 405, logex.NewError("method not allowed"))
+		return
+	case action == "":
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJsonError(w, 405, logex.NewError("method not allowed"))
+		return
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		writeJsonError(w, 409, err)
+		return
+	}
+
+	job, err := a.m.Get(id)
+	if err != nil {
+		writeJsonError(w, 404, err)
+		return
+	}
+	writeJson(w, 200, job)
+}
+
+// eventsHandler sends a "job" event once the status of a job is changed,
+// and a "remove" event with the id once a job is removed.
+func (a *api) eventsHandler(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, 500, logex.NewError("streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	last := make(map[string]JobStatus)
+	for {
+		seen := make(map[string]bool)
+		for _, job := range a.m.Jobs() {
+			seen[job.Id] = true
+			if old, ok := last[job.Id]; ok && old.State == job.State &&
+				old.Written == job.Written && old.Speed == job.Speed {
+				continue
+			}
+			last[job.Id] = *job
+			data, err := json.Marshal(job)
+			if err != nil {
+				logex.Error(err)
+				continue
+			}
+			fmt.Fprintf(w, "event: job\ndata: %s\n\n", data)
+		}
+		for id := range last {
+			if !seen[id] {
+				delete(last, id)
+				fmt.Fprintf(w, "event: remove\ndata: %q\n\n", id)
+			}
+		}
+		flusher.Flush()
+
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
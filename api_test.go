@@ -0,0 +1,110 @@
+package godl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestManager(t *testing.T, allow []string) *Manager {
+	m, err := NewManager(&ManagerConfig{
+		Dir:      t.TempDir(),
+		BlockBit: 16,
+		Conn:     2,
+		Task:     new(TaskConfig),
+		Allow:    allow,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func postJob(t *testing.T, url, token, body string) (int, *JobStatus) {
+	req, _ := http.NewRequest("POST", url+"/jobs", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var s JobStatus
+	json.NewDecoder(resp.Body).Decode(&s)
+	return resp.StatusCode, &s
+}
+
+func TestApiJobPath(t *testing.T) {
+	origin := newTestOrigin(t, []byte("godl"), 0)
+	m := newTestManager(t, []string{"127.0.0.1"})
+	mux := http.NewServeMux()
+	BindApi(mux, m, "")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, out := range []string{"../x", "a/../../x", "/tmp/x", "a/.."} {
+		body := `{"url":"` + origin.URL + `/f","out":"` + out + `"}`
+		if code, _ := postJob(t, srv.URL, "", body); code != 400 {
+			t.Fatal("out", out, "is accepted:", code)
+		}
+	}
+	if code, _ := postJob(t, srv.URL, "", `{"url":"file:///etc/passwd"}`); code != 400 {
+		t.Fatal("file url is accepted:", code)
+	}
+	code, s := postJob(t, srv.URL, "", `{"url":"`+origin.URL+`/f","out":"a/b/../c"}`)
+	if code != 201 || !strings.HasSuffix(s.Dir, "a") || s.Name != "c" {
+		t.Fatal("unexpected job:", code, s.Dir, s.Name)
+	}
+	waitJob(t, m, s.Id, JOB_DONE)
+}
+
+func TestApiToken(t *testing.T) {
+	m := newTestManager(t, nil)
+	mux := http.NewServeMux()
+	BindApi(mux, m, "s3cret")
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	for _, c := range []struct {
+		path   string
+		header string
+		code   int
+	}{
+		{"/jobs", "", 401},
+		{"/jobs", "Bearer bad", 401},
+		{"/jobs", "Bearer s3cret", 200},
+		{"/jobs?token=s3cret", "", 200},
+		{"/jobs/unknown", "", 401},
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+c.path, nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.code {
+			t.Fatal(c.path, c.header, "expect", c.code, "got", resp.StatusCode)
+		}
+	}
+}
+
+func TestManagerDenyInternal(t *testing.T) {
+	origin := newTestOrigin(t, bytes.Repeat([]byte("godl"), 1<<10), 0)
+	m := newTestManager(t, nil)
+	s, err := m.Add(&JobSpec{Urls: []string{origin.URL + "/f"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = waitJob(t, m, s.Id, JOB_FAILED)
+	if !strings.Contains(s.Error, "not allowed") {
+		t.Fatal("unexpected error:", s.Error)
+	}
+}
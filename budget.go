@@ -0,0 +1,33 @@
+package godl
+
+import "context"
+
+// ConnBudget limits the connections shared by several tasks, a connection
+// holds it while transferring a block.
+type ConnBudget struct {
+	ch chan struct{}
+}
+
+func NewConnBudget(n int) *ConnBudget {
+	return &ConnBudget{make(chan struct{}, n)}
+}
+
+// a nil budget is unlimited
+func (b *ConnBudget) acquire(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	select {
+	case b.ch <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *ConnBudget) release() {
+	if b == nil {
+		return
+	}
+	<-b.ch
+}
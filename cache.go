@@ -0,0 +1,420 @@
+package godl
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/logex.v1"
+)
+
+// the blocks of BlockCache are aligned to CACHE_BLOCK_SIZE
+const CACHE_BLOCK_SIZE = 1 << 20
+
+// the HEAD of a source is cached in memory in this duration
+const sourceInfoTTL = 30 * time.Second
+
+// BlockCache stores the blocks of the files downloaded by the godl proxy on
+// disk, keyed by the url, the ETag and the forwarded headers. Only the
+// sources with an ETag are cached. The least recently used blocks are
+// evicted once the size exceeds the limit.
+type BlockCache struct {
+	dir     string
+	maxSize int64
+	size    int64
+	// of *cacheEntry, the front is the most recently used
+	lru      *list.List
+	entries  map[string]*list.Element
+	fetching map[string]*cacheFetch
+	sync.Mutex
+}
+
+type cacheEntry struct {
+	key  string
+	size int64
+}
+
+// the fetch of a block, shared by the concurrent requests
+type cacheFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// NewBlockCache loads the blocks in dir, the ones modified earlier are
+// evicted first. The files not named by the keys are left alone.
+func NewBlockCache(dir string, maxSize int64) (*BlockCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, logex.Trace(err)
+	}
+	c := &BlockCache{
+		dir:      dir,
+		maxSize:  maxSize,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		fetching: make(map[string]*cacheFetch),
+	}
+
+	var files []os.FileInfo
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		key := strings.TrimSuffix(fi.Name(), ".tmp")
+		if !isCacheKey(key) || filepath.Dir(path) != filepath.Dir(c.path(key)) {
+			// not ours, never touch it
+			return nil
+		}
+		if key != fi.Name() {
+			// interrupted
+			os.Remove(path)
+			return nil
+		}
+		files = append(files, fi)
+		return nil
+	})
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	for _, fi := range files {
+		c.entries[fi.Name()] = c.lru.PushFront(&cacheEntry{fi.Name(), fi.Size()})
+		c.size += fi.Size()
+	}
+	c.Lock()
+	c.evict()
+	c.Unlock()
+	return c, nil
+}
+
+// the keys are the hex of sha256, see sourceInfo.blockKey
+func isCacheKey(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+func (c *BlockCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the block from disk, or fetches it by fetch. The concurrent
+// fetches of the same block are merged.
+func (c *BlockCache) get(key string, fetch func() ([]byte, error)) ([]byte, error) {
+	if data, ok := c.load(key); ok {
+		return data, nil
+	}
+
+	c.Lock()
+	if f, ok := c.fetching[key]; ok {
+		c.Unlock()
+		<-f.done
+		return f.data, f.err
+	}
+	f := &cacheFetch{done: make(chan struct{})}
+	c.fetching[key] = f
+	c.Unlock()
+
+	f.data, f.err = fetch()
+	if f.err == nil {
+		if err := c.put(key, f.data); err != nil {
+			logex.Error(err)
+		}
+	}
+	c.Lock()
+	delete(c.fetching, key)
+	c.Unlock()
+	close(f.done)
+	return f.data, f.err
+}
+
+func (c *BlockCache) load(key string) ([]byte, bool) {
+	c.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(e)
+	}
+	c.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		// removed by others, fetch it again
+		c.Lock()
+		if c.entries[key] == e {
+			c.remove(e)
+		}
+		c.Unlock()
+		return nil, false
+	}
+	return data, true
+}
+
+func (c *BlockCache) put(key string, data []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return logex.Trace(err)
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return logex.Trace(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return logex.Trace(err)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size -= e.Value.(*cacheEntry).size
+		c.lru.Remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key, int64(len(data))})
+	c.size += int64(len(data))
+	c.evict()
+	return nil
+}
+
+// must be called with lock held
+func (c *BlockCache) remove(e *list.Element) {
+	entry := e.Value.(*cacheEntry)
+	c.lru.Remove(e)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// must be called with lock held
+func (c *BlockCache) evict() {
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		e := c.lru.Back()
+		key := e.Value.(*cacheEntry).key
+		c.remove(e)
+		if err := os.Remove(c.path(key)); err != nil {
+			logex.Error(err)
+		}
+	}
+}
+
+// the HEAD of a source through the godl proxy
+type sourceInfo struct {
+	// the url, the etag and the forwarded headers
+	key          string
+	Source       string
+	Size         int64
+	Etag         string
+	ContentType  string
+	LastModified string
+	expires      time.Time
+}
+
+func (s *sourceInfo) cacheable() bool {
+	return s.Etag != "" && s.Size > 0
+}
+
+func (s *sourceInfo) blockKey(idx int64) string {
+	sum := sha256.Sum256([]byte(s.key + "\n" + strconv.FormatInt(idx, 10)))
+	return hex.EncodeToString(sum[:])
+}
+
+type sourceInfos struct {
+	infos map[string]*sourceInfo
+	sync.Mutex
+}
+
+func newSourceInfos() *sourceInfos {
+	return &sourceInfos{infos: make(map[string]*sourceInfo)}
+}
+
+func (s *sourceInfos) get(key string) *sourceInfo {
+	s.Lock()
+	defer s.Unlock()
+	info := s.infos[key]
+	if info == nil || time.Now().After(info.expires) {
+		return nil
+	}
+	return info
+}
+
+func (s *sourceInfos) put(key string, info *sourceInfo) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.infos) >= 1024 {
+		now := time.Now()
+		for k, i := range s.infos {
+			if now.After(i.expires) {
+				delete(s.infos, k)
+			}
+		}
+	}
+	s.infos[key] = info
+}
+
+func (s *sourceInfos) remove(key string) {
+	s.Lock()
+	delete(s.infos, key)
+	s.Unlock()
+}
+
+func sourceKey(cfg *ProxyConfig) string {
+	keys := make([]string, 0, len(cfg.Header))
+	for k := range cfg.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	key := cfg.Url
+	for _, k := range keys {
+		key += "\n" + k + ": " + strings.Join(cfg.Header[k], ",")
+	}
+	return key
+}
+
+func (p *proxyServer) sourceInfo(cfg *ProxyConfig) (*sourceInfo, error) {
+	key := sourceKey(cfg)
+	if info := p.infos.get(key); info != nil {
+		return info, nil
+	}
+	resp, err := p.send("HEAD", cfg, -1, -1, "")
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return nil, newStatusError(resp)
+	}
+	info := &sourceInfo{
+		Source:       resp.Header.Get(H_SOURCE),
+		Size:         resp.ContentLength,
+		Etag:         resp.Header.Get(H_ETAG),
+		ContentType:  resp.Header.Get("Content-Type"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		expires:      time.Now().Add(sourceInfoTTL),
+	}
+	if resp.Header.Get(H_ACCEPT_RANGES) != "bytes" {
+		info.Etag = ""
+	}
+	info.key = key + "\n" + info.Etag
+	p.infos.put(key, info)
+	return info, nil
+}
+
+// fetchBlock downloads the idx block of the source, an error is returned
+// if the source is changed.
+func (p *proxyServer) fetchBlock(cfg *ProxyConfig, info *sourceInfo, idx int64) ([]byte, error) {
+	off := idx * CACHE_BLOCK_SIZE
+	n := info.Size - off
+	if n > CACHE_BLOCK_SIZE {
+		n = CACHE_BLOCK_SIZE
+	}
+	ifRange := ""
+	if !strings.HasPrefix(info.Etag, "W/") {
+		ifRange = info.Etag
+	}
+	resp, err := p.send("GET", cfg, off, off+n, ifRange)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	defer resp.Body.Close()
+
+	etag := resp.Header.Get(H_ETAG)
+	switch {
+	case resp.StatusCode == 200, etag != "" && etag != info.Etag:
+		p.infos.remove(sourceKey(cfg))
+		return nil, logex.NewError("source is changed:", cfg.Url)
+	case resp.StatusCode != 206:
+		return nil, newStatusError(resp)
+	case !strings.HasPrefix(resp.Header.Get(H_CONTENT_RANGE), fmt.Sprintf("bytes %d-", off)):
+		return nil, logex.NewError("range not matched:", resp.Header.Get(H_CONTENT_RANGE))
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return data, nil
+}
+
+// serveCache serves the range by the cache, false is returned if the
+// source can't be cached, and nothing is written to w.
+func (p *proxyServer) serveCache(w http.ResponseWriter, cfg *ProxyConfig) bool {
+	info, err := p.sourceInfo(cfg)
+	if err != nil || !info.cacheable() {
+		return false
+	}
+	if cfg.IfRange != "" && cfg.IfRange != info.Etag && cfg.IfRange != info.LastModified {
+		// let the source tell if it's changed
+		return false
+	}
+	start, end := cfg.Start, cfg.End
+	if end <= 0 || end > info.Size {
+		end = info.Size
+	}
+	if start >= end {
+		return false
+	}
+
+	idx := start / CACHE_BLOCK_SIZE
+	fetch := func(idx int64) ([]byte, error) {
+		return p.cache.get(info.blockKey(idx), func() ([]byte, error) {
+			return p.fetchBlock(cfg, info, idx)
+		})
+	}
+	data, err := fetch(idx)
+	if err != nil {
+		logex.Error(err)
+		return false
+	}
+
+	h := w.Header()
+	h.Set(H_SOURCE, info.Source)
+	h.Set(H_ETAG, info.Etag)
+	h.Set(H_ACCEPT_RANGES, "bytes")
+	h.Set(H_CONTENT_LENGTH, strconv.FormatInt(end-start, 10))
+	h.Set(H_CONTENT_RANGE, fmt.Sprintf("bytes %d-%d/%d", start, end-1, info.Size))
+	if info.ContentType != "" {
+		h.Set("Content-Type", info.ContentType)
+	}
+	if info.LastModified != "" {
+		h.Set("Last-Modified", info.LastModified)
+	}
+	w.WriteHeader(206)
+
+	for {
+		off := idx * CACHE_BLOCK_SIZE
+		lo, hi := int64(0), int64(len(data))
+		if start > off {
+			lo = start - off
+		}
+		if end-off < hi {
+			hi = end - off
+		}
+		if _, err := w.Write(data[lo:hi]); err != nil {
+			return true
+		}
+		idx++
+		if idx*CACHE_BLOCK_SIZE >= end {
+			return true
+		}
+		if data, err = fetch(idx); err != nil {
+			// the client will retry the rest
+			logex.Error(err)
+			return true
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package godl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func cacheHas(c *BlockCache, key string) bool {
+	c.Lock()
+	_, ok := c.entries[key]
+	c.Unlock()
+	_, err := os.Stat(c.path(key))
+	return ok && err == nil
+}
+
+func TestBlockCacheEvict(t *testing.T) {
+	c, err := NewBlockCache(t.TempDir(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := bytes.Repeat([]byte("x"), 10)
+	for _, key := range []string{"aa01", "bb02"} {
+		if err := c.put(key, block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// aa01 is the most recently used now
+	if data, ok := c.load("aa01"); !ok || !bytes.Equal(data, block) {
+		t.Fatal("aa01 is not cached")
+	}
+	if err := c.put("cc03", block); err != nil {
+		t.Fatal(err)
+	}
+	if cacheHas(c, "bb02") {
+		t.Fatal("the least recently used block is not evicted")
+	}
+	if !cacheHas(c, "aa01") || !cacheHas(c, "cc03") {
+		t.Fatal("the recently used blocks are evicted")
+	}
+	if c.size != 20 {
+		t.Fatal("unexpected size:", c.size)
+	}
+
+	// larger than the limit
+	if err := c.put("dd04", bytes.Repeat([]byte("x"), 30)); err != nil {
+		t.Fatal(err)
+	}
+	if c.size != 0 || c.lru.Len() != 0 {
+		t.Fatal("unexpected size:", c.size, c.lru.Len())
+	}
+}
+
+func testCacheKey(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBlockCacheReload(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewBlockCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := bytes.Repeat([]byte("x"), 10)
+	keys := []string{testCacheKey("a"), testCacheKey("b"), testCacheKey("c")}
+	now := time.Now()
+	for i, key := range keys {
+		if err := c.put(key, block); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(time.Duration(i-3) * time.Minute)
+		if err := os.Chtimes(c.path(key), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// interrupted write
+	tmp := c.path(testCacheKey("d")) + ".tmp"
+	os.MkdirAll(filepath.Dir(tmp), 0755)
+	if err := ioutil.WriteFile(tmp, block, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// the files not written by the cache, they are older than the blocks
+	misplaced := testCacheKey("e")
+	foreign := []string{
+		filepath.Join(dir, "a"),
+		filepath.Join(dir, "a.tmp"),
+		filepath.Join(dir, "README"),
+		filepath.Join(dir, misplaced),
+		filepath.Join(dir, "zz", misplaced),
+	}
+	for _, f := range foreign {
+		os.MkdirAll(filepath.Dir(f), 0755)
+		if err := ioutil.WriteFile(f, block, 0644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-time.Hour)
+		os.Chtimes(f, mtime, mtime)
+	}
+
+	c, err = NewBlockCache(dir, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cacheHas(c, keys[0]) || !cacheHas(c, keys[1]) || !cacheHas(c, keys[2]) {
+		t.Fatal("the oldest block is not evicted")
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Fatal("the interrupted block is not removed")
+	}
+	if c.lru.Len() != 2 || c.size != 20 {
+		t.Fatal("unexpected blocks:", c.lru.Len(), c.size)
+	}
+	for _, f := range foreign {
+		if _, err := os.Stat(f); err != nil {
+			t.Fatal("the foreign file is touched:", f)
+		}
+	}
+}
+
+func TestBlockCacheGetShared(t *testing.T) {
+	c, err := NewBlockCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return []byte("godl"), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := c.get("aa01", fetch)
+			if err != nil || string(data) != "godl" {
+				t.Error("unexpected block:", string(data), err)
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatal("the block is fetched", n, "times")
+	}
+
+	// served from disk
+	data, err := c.get("aa01", func() ([]byte, error) {
+		t.Fatal("the cached block is fetched")
+		return nil, nil
+	})
+	if err != nil || string(data) != "godl" {
+		t.Fatal("unexpected block:", string(data), err)
+	}
+}
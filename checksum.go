@@ -0,0 +1,166 @@
+package godl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/logex.v1"
+)
+
+const (
+	H_DIGEST      = "Digest"
+	H_REPR_DIGEST = "Repr-Digest"
+	H_CONTENT_MD5 = "Content-Md5"
+	H_GOOG_HASH   = "X-Goog-Hash"
+)
+
+// Checksum is an expected digest of the whole file.
+type Checksum struct {
+	Algo string
+	Sum  []byte
+}
+
+var hashFuncs = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+	"crc32c": func() hash.Hash {
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	},
+}
+
+// the names used by the Digest headers
+var digestAlgos = map[string]string{
+	"md5":     "md5",
+	"sha":     "sha1",
+	"sha-1":   "sha1",
+	"sha-256": "sha256",
+	"sha-512": "sha512",
+	"crc32c":  "crc32c",
+}
+
+func newChecksum(algo, sum string) (*Checksum, error) {
+	algo = strings.ToLower(strings.Replace(algo, "-", "", -1))
+	h, ok := hashFuncs[algo]
+	if !ok {
+		return nil, logex.NewError("unsupported checksum algorithm:", algo)
+	}
+	size := h().Size()
+	sum = strings.TrimSpace(sum)
+	if b, err := hex.DecodeString(sum); err == nil && len(b) == size {
+		return &Checksum{algo, b}, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(sum); err == nil && len(b) == size {
+		return &Checksum{algo, b}, nil
+	}
+	return nil, logex.NewError("invalid", algo, "checksum:", sum)
+}
+
+// ParseChecksum parses "<algo>=<hex or base64 digest>", eg. "sha256=e3b0c4...".
+// md5, sha1, sha256, sha512 and crc32c are supported.
+func ParseChecksum(s string) (*Checksum, error) {
+	idx := strings.Index(s, "=")
+	if idx <= 0 {
+		return nil, logex.NewError("checksum must be <algo>=<digest>:", s)
+	}
+	c, err := newChecksum(s[:idx], s[idx+1:])
+	return c, logex.Trace(err)
+}
+
+func (c *Checksum) String() string {
+	return c.Algo + "=" + hex.EncodeToString(c.Sum)
+}
+
+func (c *Checksum) Hash() hash.Hash {
+	return hashFuncs[c.Algo]()
+}
+
+func (c *Checksum) Equal(sum []byte) bool {
+	return bytes.Equal(c.Sum, sum)
+}
+
+type ChecksumError struct {
+	Expect *Checksum
+	Actual []byte
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch: expect %v, got %v=%x",
+		e.Expect, e.Expect.Algo, e.Actual)
+}
+
+// VerifyFile hashes the file once and compares it with every checksum.
+func VerifyFile(path string, sums []*Checksum) error {
+	if len(sums) == 0 {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	defer f.Close()
+
+	hashes := make([]hash.Hash, len(sums))
+	writers := make([]io.Writer, len(sums))
+	for i, c := range sums {
+		hashes[i] = c.Hash()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return logex.Trace(err)
+	}
+	for i, c := range sums {
+		if sum := hashes[i].Sum(nil); !c.Equal(sum) {
+			return &ChecksumError{c, sum}
+		}
+	}
+	return nil
+}
+
+// parse the checksums provided by server in
+//
+//	Digest: SHA-256=base64,MD5=base64
+//	Repr-Digest: sha-256=:base64:
+//	Content-MD5: base64
+//	x-goog-hash: crc32c=base64,md5=base64
+func parseDigestHeader(h http.Header) []*Checksum {
+	var ret []*Checksum
+	add := func(algo, sum string) {
+		algo, ok := digestAlgos[strings.ToLower(strings.TrimSpace(algo))]
+		if !ok {
+			return
+		}
+		c, err := newChecksum(algo, strings.Trim(strings.TrimSpace(sum), ":"))
+		if err != nil {
+			logex.Info("ignore server digest:", err)
+			return
+		}
+		ret = append(ret, c)
+	}
+	for _, key := range []string{H_DIGEST, H_REPR_DIGEST, H_GOOG_HASH} {
+		for _, v := range h[key] {
+			for _, item := range strings.Split(v, ",") {
+				if idx := strings.Index(item, "="); idx > 0 {
+					add(item[:idx], item[idx+1:])
+				}
+			}
+		}
+	}
+	if md5sum := h.Get(H_CONTENT_MD5); md5sum != "" {
+		add("md5", md5sum)
+	}
+	return ret
+}
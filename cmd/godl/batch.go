@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chzyer/godl"
+	"gopkg.in/logex.v1"
+)
+
+// batchItem is a task in the input file of batch mode, the format is like:
+//
+//	# comment
+//	http://example.com/a.iso<TAB>http://mirror.example.com/a.iso
+//	  out=b.iso
+//	  header=Authorization: Bearer xxx
+//	  checksum=sha256=<hex>
+//
+// the urls separated by tab are the mirrors of the same file, and the
+// indented lines are the options of the previous url.
+type batchItem struct {
+	Line     int
+	Urls     []string
+	Name     string
+	Headers  []string
+	Checksum string
+}
+
+// fileName returns the name of the file, it's guessed from the url if out
+// is not specified.
+func (b *batchItem) fileName() string {
+	if b.Name != "" {
+		return filepath.Base(b.Name)
+	}
+	u, err := url.Parse(b.Urls[0])
+	if err != nil {
+		return b.Urls[0]
+	}
+	return path.Base(u.Path)
+}
+
+func parseBatch(r io.Reader) ([]*batchItem, error) {
+	var (
+		items []*batchItem
+		last  *batchItem
+		line  int
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		if text[0] != ' ' && text[0] != '\t' {
+			last = &batchItem{Line: line}
+			for _, u := range strings.Split(trimmed, "\t") {
+				if u = strings.TrimSpace(u); u != "" {
+					last.Urls = append(last.Urls, u)
+				}
+			}
+			items = append(items, last)
+			continue
+		}
+
+		if last == nil {
+			return nil, logex.NewError("line", line, ": option without url")
+		}
+		idx := strings.Index(trimmed, "=")
+		if idx <= 0 {
+			return nil, logex.NewError("line", line, ": invalid option", trimmed)
+		}
+		key, val := strings.TrimSpace(trimmed[:idx]), strings.TrimSpace(trimmed[idx+1:])
+		switch key {
+		case "out", "o":
+			last.Name = val
+		case "header", "H":
+			last.Headers = append(last.Headers, val)
+		case "checksum":
+			last.Checksum = val
+		default:
+			return nil, logex.NewError("line", line, ": unknown option", key)
+		}
+	}
+	return items, logex.Trace(scanner.Err())
+}
+
+type batchResult struct {
+	Name    string
+	Size    int64
+	Elapsed time.Duration
+	Err     error
+}
+
+func runBatchItem(ctx context.Context, c *Config, cwd string, item *batchItem, budget *godl.ConnBudget) *batchResult {
+	ret := &batchResult{Name: item.Urls[0]}
+	tcfg := c.taskConfig()
+	tcfg.Progress = false
+	tcfg.Budget = budget
+	tcfg.Headers = append(append([]string(nil), c.Headers...), item.Headers...)
+	if item.Name != "" {
+		tcfg.Name = item.Name
+	}
+	if item.Checksum != "" {
+		tcfg.Checksum = item.Checksum
+	}
+
+	start := time.Now()
+	task, err := newTask(item.Urls, cwd, c.BlockBit, tcfg)
+	if err != nil {
+		ret.Err = err
+		return ret
+	}
+	ret.Name = task.Meta.Name
+	ret.Size = task.Meta.FileSize
+	ret.Err = task.ScheduleContext(ctx, c.ConnSize)
+	finishTask(task, ret.Err)
+	ret.Elapsed = time.Now().Sub(start)
+	if ret.Err == nil {
+		logex.Info("finished", ret.Name)
+	}
+	return ret
+}
+
+// download the urls listed in c.Input concurrently, and print the summary
+func batchDn(c *Config, cwd string) {
+	r := io.Reader(os.Stdin)
+	if c.Input != "-" {
+		f, err := os.Open(c.Input)
+		if err != nil {
+			logex.Fatal(err)
+		}
+		defer f.Close()
+		r = f
+	}
+	items, err := parseBatch(r)
+	if err != nil {
+		logex.Fatal(err)
+	}
+	if c.Jobs <= 0 {
+		c.Jobs = 1
+	}
+
+	var (
+		ctx     = signalContext()
+		budget  *godl.ConnBudget
+		results = make([]*batchResult, len(items))
+		jobs    = make(chan struct{}, c.Jobs)
+		wg      sync.WaitGroup
+	)
+	if c.Budget > 0 {
+		budget = godl.NewConnBudget(c.Budget)
+	}
+	// the items of the same file would share the part and meta file
+	owners := make(map[string]int)
+	for i, item := range items {
+		name := item.fileName()
+		if line, ok := owners[name]; ok {
+			results[i] = &batchResult{
+				Name: item.Urls[0],
+				Err:  logex.NewError("same file as line", line, ":", name),
+			}
+			continue
+		}
+		owners[name] = item.Line
+		select {
+		case jobs <- struct{}{}:
+		case <-ctx.Done():
+			results[i] = &batchResult{Name: item.Urls[0], Err: ctx.Err()}
+			continue
+		}
+		wg.Add(1)
+		go func(i int, item *batchItem) {
+			defer wg.Done()
+			results[i] = runBatchItem(ctx, c, cwd, item, budget)
+			<-jobs
+		}(i, item)
+	}
+	wg.Wait()
+
+	if printSummary(os.Stdout, results) > 0 {
+		os.Exit(1)
+	}
+}
+
+// returns the count of failed tasks
+func printSummary(w io.Writer, results []*batchResult) (failed int) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tSIZE\tTIME\tFILE\tERROR")
+	for _, r := range results {
+		status, errInfo := "ok", ""
+		if r.Err != nil {
+			status, errInfo = "failed", r.Err.Error()
+			failed++
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", status,
+			godl.FormatSize(r.Size), r.Elapsed/time.Second*time.Second,
+			r.Name, errInfo)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d succeeded, %d failed\n", len(results)-failed, failed)
+	return failed
+}
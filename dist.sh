@@ -13,7 +13,7 @@ mkdir -p tmp/godl build
 echo 'linux/amd64
 darwin/amd64' | awk -F/ '{print "GOOS="$1" GOARCH="$2}' | while read line; do
 	export $line
-	go build -o tmp/godl/godl *.go
+	go build -o tmp/godl/godl ./cmd/godl
 	cd tmp
 	tar zcvf ../build/godl.$GOOS-${GOARCH}$version.tgz godl
 	cd ../
@@ -1,12 +1,16 @@
-package main
+package godl
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
 	"strings"
@@ -26,15 +30,53 @@ type TaskConfig struct {
 	ShowRealSp bool
 	Headers    []string
 	Proxy      []string
+
+	// expected digest of the file, eg. "sha256=<hex>", see ParseChecksum
+	Checksum string
+	// DefaultRetryPolicy is used if nil
+	Retry *RetryPolicy
+	// the name of target file, it's guessed from the url if empty
+	Name string
+	// the preferred location of the sources in metalink, eg. "de"
+	Location string
+	// shared with other tasks, unlimited if nil
+	Budget *ConnBudget
+	// used to connect the https proxies, see NewClientTLSConfig
+	ProxyTLS *tls.Config
+	// resume the streams of the servers without range support by the query
+	// parameters, see ResumeParam
+	ResumeParams []ResumeParam
+	// the strategy to preallocate the target file, PREALLOC_NONE if empty
+	Prealloc string
+	// the mtime of the file is set to the Last-Modified of server
+	KeepMtime bool
+	// the permission of the file, it's created by 0666 and umask if 0
+	FileMode os.FileMode
+	// the client to the sources, DefaultClient if nil
+	Client *http.Client
 }
 
 func (t *TaskConfig) init() {
+	if t.Retry == nil {
+		t.Retry = DefaultRetryPolicy
+	}
+	if t.Client == nil {
+		t.Client = DefaultClient
+	}
 }
 
 type DnTask struct {
 	*TaskConfig
-	source *url.URL
-	Meta   *Meta
+	source  *url.URL
+	Meta    *Meta
+	mirrors *mirrorSet
+	routes  *routeSet
+	// the client of the godl proxies
+	proxyClient *http.Client
+
+	// the expected checksums of the whole file and the pieces
+	checksums []*Checksum
+	pieces    *MetalinkPieces
 
 	file     *os.File
 	writeOp  chan *writeOp
@@ -46,16 +88,25 @@ type DnTask struct {
 	rateLimit *RateLimit
 
 	downloadPerSecond int64
+	// the count of failed transfers, used by autoScale
+	failures int64
 
 	l *Liner
 }
 
 func NewDnTaskAuto(url_, pwd string, bit uint, cfg *TaskConfig) (*DnTask, error) {
+	if cfg == nil {
+		cfg = new(TaskConfig)
+	}
+	if isMetalinkPath(url_) {
+		return NewDnTaskMetalink(url_, pwd, bit, cfg)
+	}
 	_, err := os.Stat(url_)
 	if !cfg.Clean && err == nil {
 		if meta, _ := NewMetaFormFile(url_); meta != nil {
 			logex.Info("downloading form", meta.Source)
-			return NewDnTask(meta.Source, pwd, meta.BlkBit, cfg)
+			urls := append([]string{meta.Source}, meta.Mirrors...)
+			return NewDnTaskMirrors(urls, pwd, meta.BlkBit, cfg)
 		}
 	}
 
@@ -63,41 +114,82 @@ func NewDnTaskAuto(url_, pwd string, bit uint, cfg *TaskConfig) (*DnTask, error)
 }
 
 func NewDnTask(url_, pwd string, bit uint, cfg *TaskConfig) (*DnTask, error) {
-	if url_ == "" {
+	return NewDnTaskMirrors([]string{url_}, pwd, bit, cfg)
+}
+
+// NewDnTaskMirrors creates a task downloading from several sources of the
+// same file. The first url is the primary one, the others are checked by
+// HEAD and dropped if they don't serve the same file.
+func NewDnTaskMirrors(urls []string, pwd string, bit uint, cfg *TaskConfig) (*DnTask, error) {
+	return newDnTask(urls, pwd, bit, cfg, nil)
+}
+
+// metalink is nil if the task is not created from a metalink
+func newDnTask(urls []string, pwd string, bit uint, cfg *TaskConfig, metalink *MetalinkFile) (*DnTask, error) {
+	if len(urls) == 0 || urls[0] == "" {
 		return nil, logex.NewError("url is empty")
 	}
+	url_ := urls[0]
 	if cfg == nil {
 		cfg = new(TaskConfig)
 	}
 	cfg.init()
+	if err := checkPrealloc(cfg.Prealloc); err != nil {
+		return nil, logex.Trace(err)
+	}
 
 	source, err := url.Parse(url_)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
-	meta, err := NewMeta(pwd, url_, bit, cfg.Clean)
+	var checksums []*Checksum
+	if cfg.Checksum != "" {
+		checksum, err := ParseChecksum(cfg.Checksum)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		checksums = append(checksums, checksum)
+	}
+	meta, err := newMeta(pwd, cfg.Name, url_, bit, cfg.Clean)
 	if err != nil {
 		return nil, logex.Trace(err)
 	}
+	meta.client = cfg.Client
 
 	dn := &DnTask{
 		TaskConfig: cfg,
 		rateLimit:  NewRateLimit(cfg.MaxSpeed),
 		source:     source,
 		Meta:       meta,
+		checksums:  checksums,
 		writeOp:    make(chan *writeOp, 1<<3),
 		stopChan:   make(chan struct{}),
 		start:      time.Now(),
 		l:          NewLiner(os.Stderr),
+
+		proxyClient: newProxyClient(cfg.ProxyTLS),
+		routes:      newRouteSet(cfg.Proxy),
 	}
 	if cfg.Clean {
-		os.Remove(dn.Meta.targetPath())
+		os.Remove(dn.Meta.TargetPath())
+		os.Remove(dn.Meta.PartPath())
 	}
 
-	if err = dn.Meta.retrieveFromDisk(cfg.Proxy); err != nil {
+	if err = dn.Meta.retrieveFromDisk(cfg.Proxy, dn.proxyClient, cfg.Headers); err != nil {
 		dn.Meta.Remove()
 		return nil, logex.Trace(err)
 	}
+	dn.Meta.Mirrors = nil
+	dn.mirrors = newMirrorSet(dn.Meta.Source)
+	dn.addMirrors(urls[1:])
+	if metalink != nil {
+		if err = dn.applyMetalink(metalink); err != nil {
+			dn.Meta.Close()
+			return nil, logex.Trace(err)
+		}
+	} else {
+		dn.discoverMetalink()
+	}
 
 	if err = dn.Meta.Sync(); err != nil {
 		return nil, logex.Trace(err)
@@ -106,14 +198,44 @@ func NewDnTask(url_, pwd string, bit uint, cfg *TaskConfig) (*DnTask, error) {
 	if err = dn.openFile(); err != nil {
 		return nil, logex.Trace(err)
 	}
+	if err = dn.preallocate(); err != nil {
+		dn.file.Close()
+		dn.Meta.Close()
+		return nil, logex.Trace(err)
+	}
 
 	go dn.ioloop()
+	dn.wg.Add(1)
 	go dn.progress()
 	return dn, nil
 }
 
+// addMirrors checks and adds the other sources of the file
+func (d *DnTask) addMirrors(urls []string) {
+	var added []string
+	for _, u := range urls {
+		if u == "" || u == d.Meta.Source || inStrings(d.Meta.Mirrors, u) {
+			continue
+		}
+		added = append(added, u)
+		d.Meta.Mirrors = append(d.Meta.Mirrors, u)
+	}
+	if len(added) > 0 && d.Meta.IsAccpetRange() {
+		d.mirrors.add(d.Meta, added, d.Headers)
+	}
+}
+
+func inStrings(ss []string, s string) bool {
+	for _, ss := range ss {
+		if ss == s {
+			return true
+		}
+	}
+	return false
+}
+
 func (d *DnTask) openFile() error {
-	f, err := os.OpenFile(d.Meta.targetPath(), os.O_RDWR|os.O_CREATE, 0666)
+	f, err := os.OpenFile(d.Meta.PartPath(), os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return logex.Trace(err)
 	}
@@ -140,45 +262,62 @@ func (d *DnTask) ioloop() {
 		case <-d.stopChan:
 			return
 		}
-		n, err := d.file.WriteAt(w.Buf, w.Offset)
-		if err != nil {
-			d.file.Close()
-			d.file = nil
-			if err := d.openFile(); err != nil {
-				panic(err)
-			}
-		}
-		if d.MaxSpeed > 0 {
+		n, err := d.writeAt(w.Buf, w.Offset)
+		if d.rateLimit.Max() > 0 {
 			d.rateLimit.Process(n)
 		}
 		w.Reply <- &writeOpReply{n, logex.Trace(err)}
 	}
 }
 
-// [start, end)
-func (d *DnTask) allocDnBlk(off int) (idx int, start, end int64) {
-	d.Lock()
-	defer d.Unlock()
-
-	for i := off; i < len(d.Meta.Blocks); i++ {
-		blk := d.Meta.Blocks[i]
-		if blk == nil {
-			blk = NewBlock()
-			d.Meta.Blocks[i] = blk
-		}
-		if blk.State != STATE_INIT {
-			continue
-		}
-		blk.State = STATE_PROCESS
-		offset := int64(i << d.Meta.BlkBit)
-		start = offset + int64(blk.Written)
-		end = int64((i + 1) << d.Meta.BlkBit)
-		if end > d.Meta.FileSize {
-			end = d.Meta.FileSize
+// the file will be reopened at next write if it failed
+func (d *DnTask) writeAt(b []byte, off int64) (int, error) {
+	if d.file == nil {
+		if err := d.openFile(); err != nil {
+			return 0, logex.Trace(err)
 		}
-		return i, start, end
 	}
-	return -1, -1, -1
+	n, err := d.file.WriteAt(b, off)
+	if err != nil {
+		d.file.Close()
+		d.file = nil
+		return n, logex.Trace(err)
+	}
+	return n, nil
+}
+
+// the range allocated to a connection, [start, end) of a block or a part of
+// it. The end shrinks if the tail is stolen by an idle connection.
+type dnBlk struct {
+	idx    int
+	blk    *Block
+	mirror *Mirror
+}
+
+// don't steal the tail of a block which is smaller than minStealSize.
+// The written of a connection at once (32KB by io.Copy) must be far less
+// than half of it, so that it never crosses the new end of a stolen block.
+const minStealSize = 1 << 18
+
+func (d *DnTask) allocDnBlk(off int) *dnBlk {
+	idx, blk := d.Meta.allocBlock(off, minStealSize)
+	if blk == nil {
+		return nil
+	}
+	return &dnBlk{idx, blk, d.mirrors.pick()}
+}
+
+// blkRange returns the range of the allocated block which is not written
+func (d *DnTask) blkRange(b *dnBlk) (start, end int64) {
+	s, e := d.Meta.SpanRange(b.idx, b.blk)
+	offset := int64(b.idx << d.Meta.BlkBit)
+	return offset + int64(s), offset + int64(e)
+}
+
+// blkEnd returns the current end of the allocated range
+func (d *DnTask) blkEnd(b *dnBlk) int64 {
+	_, end := d.blkRange(b)
+	return end
 }
 
 func setRange(h http.Header, start, end int64) {
@@ -194,27 +333,57 @@ func (d *DnTask) checkWritten(written, start, end int64) error {
 }
 
 // call after written, offset changed
-func (d *DnTask) onWriteFunc(offset int64, written int) error {
-	if !d.Meta.IsAccpetRange() {
-		d.Meta.MarkFinishStream(int64(written))
-		return nil
-	}
+func (d *DnTask) onStreamWrite(offset int64, buf []byte) error {
+	return logex.Trace(d.Meta.MarkStream(offset, buf))
+}
 
-	err := d.Meta.MarkFinishByN(offset, written, true)
-	return logex.Trace(err)
+func (d *DnTask) onBlkWrite(b *dnBlk) onWriteFunc {
+	return func(offset int64, buf []byte) error {
+		err := d.Meta.MarkSpanByN(b.idx, b.blk, offset, buf, true)
+		return logex.Trace(err)
+	}
 }
 
-func (d *DnTask) httpDn(client *http.Client, req *http.Request, op *writeOp, start, end int64) (int64, error) {
+func (d *DnTask) httpDn(client *http.Client, req *http.Request, op *writeOp, b *dnBlk, start, end int64) (int64, error) {
 	resp, err := client.Do(req)
 	if err != nil {
-		return 0, logex.Trace(err)
+		// keep the type for IsPermanent
+		return 0, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return 0, newStatusError(resp)
+	}
+	if b != nil && resp.StatusCode != http.StatusPartialContent {
+		// never write the whole file at the offset of block
+		resp.Body.Close()
+		if req.Header.Get(H_IF_RANGE) != "" {
+			return 0, ErrSourceChanged
+		}
+		return 0, logex.NewError("range is ignored:", resp.Status)
+	}
+	if b == nil && start > 0 {
+		if start, err = d.checkResumed(req, resp, start); err != nil {
+			resp.Body.Close()
+			return 0, logex.Trace(err)
+		}
 	}
 	rc := NewReader(resp.Body)
 	defer rc.Close()
 
 	r := bufio.NewReader(rc)
-	w := NewFileWriter(d, start, op, d.writeOp, d.onWriteFunc)
-	written, err := io.CopyN(w, r, end-start)
+	w := NewFileWriter(d, start, op, d.writeOp, d.onStreamWrite)
+	if b != nil {
+		w.onWrite = d.onBlkWrite(b)
+		w.limit = func() int64 { return d.blkEnd(b) }
+	}
+	var written int64
+	if end > 0 {
+		written, err = io.CopyN(w, r, end-start)
+	} else {
+		// the size is unknown
+		written, err = io.Copy(w, r)
+	}
 	if err != nil {
 		return written, logex.Trace(err)
 	}
@@ -228,115 +397,376 @@ func (d *DnTask) httpDn(client *http.Client, req *http.Request, op *writeOp, sta
 	return written, nil
 }
 
-func (d *DnTask) proxyGet(client *http.Client, host string, idx int, op *writeOp, start, end int64) (int64, error) {
-	proxy := proxyUrl(host, d.Meta.Source, start, end)
-	req, err := http.NewRequest("GET", proxy, nil)
+func (d *DnTask) sourceOf(b *dnBlk) string {
+	if b != nil && b.mirror != nil {
+		return b.mirror.Url
+	}
+	return d.Meta.Source
+}
+
+func setHeaders(h http.Header, headers []string) {
+	for _, kv := range headers {
+		if idx := strings.Index(kv, ":"); idx > 0 {
+			h.Set(kv[:idx], strings.TrimSpace(kv[idx+1:]))
+		}
+	}
+}
+
+func (d *DnTask) proxyGet(ctx context.Context, client *http.Client, host string, b *dnBlk, op *writeOp, start, end int64) (int64, error) {
+	req, err := newProxyRequest(ctx, "GET", host, d.sourceOf(b), start, end, d.Headers)
 	if err != nil {
 		return 0, logex.Trace(err)
 	}
-	return d.httpDn(client, req, op, start, end)
+	// sent to the source by the godl proxy
+	d.setIfRange(req.Header, d.sourceOf(b))
+	return d.httpDn(client, req, op, b, start, end)
 }
 
-func (d *DnTask) httpGet(client *http.Client, idx int, op *writeOp, start, end int64) (int64, error) {
-	req, err := http.NewRequest("GET", d.Meta.Source, nil)
-	if err != nil {
-		panic(err)
+// the mirrors may have another Etag or Last-Modified
+func (d *DnTask) setIfRange(h http.Header, source string) {
+	if v := d.Meta.ifRange(); v != "" && source == d.Meta.Source {
+		h.Set(H_IF_RANGE, v)
 	}
-	for _, h := range d.Headers {
-		if idx := strings.Index(h, ":"); idx > 0 {
-			req.Header.Set(h[:idx], strings.TrimSpace(h[idx+1:]))
-		}
+}
+
+// b is nil if the range is not acceptable, the stream is resumed from start
+func (d *DnTask) httpGet(ctx context.Context, client *http.Client, b *dnBlk, op *writeOp, start, end int64) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.sourceOf(b), nil)
+	if err != nil {
+		return 0, logex.Trace(err)
 	}
+	setHeaders(req.Header, d.Headers)
 
-	if idx >= 0 {
+	if b != nil {
 		setRange(req.Header, start, end)
-	} else {
-		start = 0
+		d.setIfRange(req.Header, req.URL.String())
+	} else if start > 0 {
+		d.resumeStream(req, start)
 	}
-	return d.httpDn(client, req, op, start, end)
+	return d.httpDn(client, req, op, b, start, end)
 }
 
-func (d *DnTask) download(t *DnType) {
+// download the blocks until all of them are handed out, the route of each
+// transfer is picked by the routeSet.
+func (d *DnTask) download(ctx context.Context) error {
 	var (
-		idx        int
-		start, end int64
-		err        error
-		retry      int
+		idx   int
+		b     *dnBlk
+		err   error
+		retry int
+		t     *DnType
 
-		maxRetry = 3
-		op       = new(writeOp)
+		op = new(writeOp)
 	)
 	op.Reply = make(chan *writeOpReply)
 
 	if !d.Meta.IsAccpetRange() {
-		_, err = d.httpGet(DefaultClient, -1, op, -1, -1)
-		if err != nil {
-			logex.Error(err)
-		}
-		return
+		return d.downloadStream(ctx, op)
 	}
 
 	for {
-		idx, start, end = d.allocDnBlk(idx)
-		if idx < 0 {
-			break
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-		if t.Proxy == "" {
-			_, err = d.httpGet(DefaultClient, idx, op, start, end)
-		} else {
-			_, err = d.proxyGet(DefaultClient, t.Proxy, idx, op, start, end)
+		if b == nil {
+			if b = d.allocDnBlk(idx); b == nil {
+				break
+			}
+			idx, retry = b.idx, 0
 		}
-		if err != nil {
-			if retry > maxRetry && !logex.Equal(err, io.EOF) {
-				logex.Error(err)
-				return
+		start, end := d.blkRange(b)
+		err = nil
+		if start < end {
+			if err = d.Budget.acquire(ctx); err != nil {
+				d.Meta.MarkInterrupt(b.blk)
+				return err
+			}
+			var written, firstByte int64
+			t = d.routes.pick()
+			begin := time.Now()
+			tctx := httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+				GotFirstResponseByte: func() {
+					atomic.StoreInt64(&firstByte, int64(time.Now().Sub(begin)))
+				},
+			})
+			if t.Proxy == "" {
+				written, err = d.httpGet(tctx, d.Client, b, op, start, end)
+			} else {
+				written, err = d.proxyGet(tctx, d.proxyClient, t.Proxy, b, op, start, end)
 			}
-			retry++
-			d.Meta.MarkInit(idx)
+			d.Budget.release()
+			if err == nil || logex.Equal(err, ErrBlkStolen) {
+				elapsed := time.Now().Sub(begin)
+				d.mirrors.succeed(b.mirror, written, elapsed)
+				d.routes.succeed(t, written, elapsed, time.Duration(atomic.LoadInt64(&firstByte)))
+			}
+		}
+		if err != nil && logex.Equal(err, ErrBlkStolen) {
+			// the rest of the block is downloading by another connection
+			err = nil
+		}
+		if err == nil {
+			b = nil
+			idx++
 			continue
 		}
 
-		idx++
+		if ctx.Err() != nil {
+			// keep the written bytes, it will be resumed next time
+			d.Meta.MarkInterrupt(b.blk)
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrSourceChanged) {
+			d.Meta.MarkInterrupt(b.blk)
+			return &BlockError{b.idx, start, end, err}
+		}
+		atomic.AddInt64(&d.failures, 1)
+		dropped := d.mirrors.fail(b.mirror, err)
+		if t != nil && d.routes.fail(t, err) {
+			// try the other routes
+			dropped = true
+		}
+		b.mirror = d.mirrors.pick()
+		if dropped {
+			// try the other mirrors
+			continue
+		}
+		if IsPermanent(err) || retry >= d.Retry.MaxRetry {
+			// give it back, it may be completed by other connections
+			d.Meta.MarkInterrupt(b.blk)
+			return &BlockError{b.idx, start, end, err}
+		}
+		delay := d.Retry.Backoff(retry, err)
+		logex.Debug("retry block", b.idx, "after", delay, "error:", err)
+		retry++
+		if !sleepContext(ctx, delay) {
+			d.Meta.MarkInterrupt(b.blk)
+			return ctx.Err()
+		}
 	}
+	return nil
 }
 
-type DnType struct {
-	Proxy string
+// downloadStream downloads the file without range support by one
+// connection, it's retried from the written offset like a block.
+func (d *DnTask) downloadStream(ctx context.Context, op *writeOp) error {
+	for retry := 0; ; retry++ {
+		start, err := d.resumeOffset()
+		if err != nil || (d.Meta.FileSize > 0 && start >= d.Meta.FileSize) {
+			return logex.Trace(err)
+		}
+		if err = d.Budget.acquire(ctx); err != nil {
+			return err
+		}
+		_, err = d.httpGet(ctx, d.Client, nil, op, start, d.Meta.FileSize)
+		d.Budget.release()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			return nil
+		}
+		atomic.AddInt64(&d.failures, 1)
+		if IsPermanent(err) || retry >= d.Retry.MaxRetry {
+			return logex.Trace(err)
+		}
+		delay := d.Retry.Backoff(retry, err)
+		logex.Debug("retry stream from", start, "after", delay, "error:", err)
+		if !sleepContext(ctx, delay) {
+			return ctx.Err()
+		}
+	}
 }
 
-func NewDnType(host string) *DnType {
-	return &DnType{host}
+// Schedule downloads the file with n connections and blocks until all of
+// them exit. An error is returned if the file could not be completed.
+// If n is not positive, the connections are adjusted by the throughput,
+// see autoScale.
+func (d *DnTask) Schedule(n int) error {
+	return d.ScheduleContext(context.Background(), n)
 }
 
-func (d *DnTask) Schedule(n int) {
-	if false && !d.Meta.IsAccpetRange() {
-		n = 1
-		logex.Info("range is not acceptable, turn to single thread")
-	}
-	if n > len(d.Meta.Blocks) {
-		logex.Info("remote file size is too small to use", n, "threads, decrease to", len(d.Meta.Blocks))
-		n = len(d.Meta.Blocks)
-	}
+// ScheduleContext is like Schedule, but the in-flight transfers are aborted
+// once ctx is done or the task is closed. In that case the Meta is synced
+// so that the download can be resumed, and ctx.Err() is returned.
+func (d *DnTask) ScheduleContext(ctx context.Context, n int) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	types := make([]*DnType, len(d.Proxy)+1)
-	for i := 0; i < len(types); i++ {
-		if i == len(types)-1 {
-			types[i] = NewDnType("")
-		} else {
-			types[i] = NewDnType(d.Proxy[i])
+	if !d.Meta.IsAccpetRange() {
+		if n > 1 {
+			logex.Info("range is not acceptable, turn to single thread")
 		}
+		n = 1
+	} else if n > 1 && n > len(d.Meta.Blocks) {
+		// at least one, n <= 0 is only for autoScale
+		max := len(d.Meta.Blocks)
+		if max < 1 {
+			max = 1
+		}
+		logex.Info("remote file size is too small to use", n, "threads, decrease to", max)
+		n = max
 	}
 
-	var wg sync.WaitGroup
-	for i := 0; i < n; i++ {
+	var (
+		wg      sync.WaitGroup
+		errLock sync.Mutex
+		blkErrs []*BlockError
+		dnErr   error
+	)
+	spawn := func(ctx context.Context, i int) <-chan struct{} {
+		done := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done)
+			err := d.download(ctx)
+			if err == nil || ctx.Err() != nil {
+				return
+			}
+			logex.Error(err)
+			errLock.Lock()
+			if be, ok := err.(*BlockError); ok {
+				blkErrs = append(blkErrs, be)
+			} else if dnErr == nil {
+				dnErr = err
+			}
+			errLock.Unlock()
+		}()
+		return done
+	}
+	if n > 0 {
+		for i := 0; i < n; i++ {
+			spawn(ctx, i)
+		}
+	} else {
 		wg.Add(1)
-		i := i
 		go func() {
-			d.download(types[i%len(types)])
-			wg.Done()
+			defer wg.Done()
+			d.autoScale(ctx, spawn)
 		}()
 	}
 	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		if syncErr := d.Meta.Sync(); syncErr != nil {
+			logex.Error(syncErr)
+		}
+		return err
+	}
+	for _, be := range blkErrs {
+		if be.Err == ErrSourceChanged {
+			return d.discard()
+		}
+	}
+	if dnErr != nil && !d.Meta.IsFinish() {
+		return logex.Trace(dnErr)
+	}
+	if d.Meta.FileSize > 0 && !d.Meta.IsFinish() {
+		return &ScheduleError{
+			Written:  atomic.LoadInt64(&d.Meta.written),
+			FileSize: d.Meta.FileSize,
+			Blocks:   blkErrs,
+		}
+	}
+	if err := d.Verify(); err != nil {
+		return err
+	}
+	return logex.Trace(d.commit())
+}
+
+// commit moves the part file to the target, with the mtime and the mode in
+// TaskConfig. It's done if the part file is gone.
+func (d *DnTask) commit() error {
+	part := d.Meta.PartPath()
+	if _, err := os.Stat(part); os.IsNotExist(err) {
+		return nil
+	}
+	if d.file != nil {
+		if err := d.file.Sync(); err != nil {
+			return logex.Trace(err)
+		}
+		d.file.Close()
+		d.file = nil
+	}
+	if d.FileMode != 0 {
+		if err := os.Chmod(part, d.FileMode); err != nil {
+			return logex.Trace(err)
+		}
+	}
+	if d.KeepMtime && d.Meta.LastModified != "" {
+		mtime, err := http.ParseTime(d.Meta.LastModified)
+		if err != nil {
+			logex.Error("invalid Last-Modified:", d.Meta.LastModified)
+		} else if err = os.Chtimes(part, mtime, mtime); err != nil {
+			return logex.Trace(err)
+		}
+	}
+	return logex.Trace(os.Rename(part, d.Meta.TargetPath()))
+}
+
+// discard drops the progress since the file is changed on server, it will
+// be downloaded again in the next run.
+func (d *DnTask) discard() error {
+	logex.Info("the file is changed on server, the progress is discarded")
+	if err := d.truncate(); err != nil {
+		logex.Error(err)
+	}
+	return ErrSourceChanged
+}
+
+// truncate drops the progress and the downloaded file.
+func (d *DnTask) truncate() error {
+	d.Meta.reset()
+	if err := d.file.Truncate(0); err != nil {
+		return logex.Trace(err)
+	}
+	if err := d.preallocate(); err != nil {
+		return logex.Trace(err)
+	}
+	return logex.Trace(d.Meta.Sync())
+}
+
+// Verify hashes the downloaded file and checks it against the checksum in
+// TaskConfig, the metalink and the digests provided by the server. A
+// *ChecksumError is returned if any of them mismatched.
+func (d *DnTask) Verify() error {
+	if d.pieces != nil {
+		bad, err := d.pieces.verify(d.Meta)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		if len(bad) > 0 {
+			return logex.NewError(len(bad), "pieces mismatched with metalink:", bad)
+		}
+	}
+
+	sums := append([]*Checksum(nil), d.checksums...)
+	sums = append(sums, d.Meta.Digests()...)
+	err := VerifyFile(d.Meta.dataPath(), sums)
+	if _, ok := err.(*ChecksumError); ok && d.Meta.IsAccpetRange() {
+		// find out the corrupted blocks, so that the next run only
+		// downloads them again.
+		bad, verr := d.Meta.VerifyBlocks()
+		if verr != nil {
+			logex.Error(verr)
+		} else {
+			logex.Info(len(bad), "blocks are corrupted")
+		}
+	}
+	return err
+}
+
+// FormatSize formats the bytes in human readable unit, eg. 1.50MB.
+func FormatSize(u int64) string {
+	return calUnit(u)
 }
 
 func calUnit(u int64) string {
@@ -361,11 +791,29 @@ func (t *DnTask) Close() {
 	close(t.stopChan)
 	t.wg.Wait()
 	t.Meta.Close()
-	t.l.Finish()
+	if t.Progress {
+		t.l.Finish()
+	}
+}
+
+// Written returns the bytes downloaded.
+func (t *DnTask) Written() int64 {
+	return atomic.LoadInt64(&t.Meta.written)
+}
+
+// SetMaxSpeed changes the speed limit of a running task, 0 means unlimited.
+func (t *DnTask) SetMaxSpeed(max int64) {
+	t.rateLimit.SetMax(max)
+	// let the blocked writes go on
+	t.rateLimit.Reset()
+}
+
+// Speed returns the bytes downloaded in the last second.
+func (t *DnTask) Speed() int64 {
+	return atomic.LoadInt64(&t.downloadPerSecond)
 }
 
 func (t *DnTask) progress() {
-	t.wg.Add(1)
 	defer t.wg.Done()
 
 	lastWritten := int64(0)
@@ -387,7 +835,7 @@ func (t *DnTask) progress() {
 		}
 		atomic.StoreInt64(&t.downloadPerSecond, written-lastWritten)
 		totalN += 1
-		if t.MaxSpeed > 0 {
+		if t.rateLimit.Max() > 0 {
 			t.rateLimit.Reset()
 		}
 		realDn := atomic.SwapInt64(&report, 0)
@@ -396,6 +844,9 @@ func (t *DnTask) progress() {
 		if t.ShowRealSp {
 			extend += fmt.Sprintf(" RL:%v", calUnit(realDn))
 		}
+		if stats := t.routes.stats(); stats != "" {
+			extend += " " + stats
+		}
 
 		if t.Progress {
 			t.l.Print(fmt.Sprintf("[%v/%v(%v%%) DL:%v TIME:%v ETA:%v %v]",
@@ -0,0 +1,51 @@
+package godl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestNewDnTaskAutoNilConfig(t *testing.T) {
+	data := bytes.Repeat([]byte("godl"), 1<<10)
+	origin := newTestOrigin(t, data, 0)
+	task, err := NewDnTaskAuto(origin.URL+"/f", t.TempDir(), 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = task.Schedule(2)
+	task.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(task.Meta.TargetPath())
+	if !bytes.Equal(got, data) {
+		t.Fatal("the file is corrupted")
+	}
+}
+
+// Schedule(0) returns once the connections exit, not at the next tick
+func TestAutoScaleReturn(t *testing.T) {
+	for _, size := range []int{0, 1 << 20} {
+		data := bytes.Repeat([]byte("g"), size)
+		origin := newTestOrigin(t, data, 0)
+		task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 16, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		begin := time.Now()
+		err = task.Schedule(0)
+		task.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d := time.Since(begin); d >= autoInterval {
+			t.Fatal("the file of", size, "bytes is done in", d)
+		}
+		got, _ := ioutil.ReadFile(task.Meta.TargetPath())
+		if !bytes.Equal(got, data) {
+			t.Fatal("the file is corrupted")
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package godl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/logex.v1"
+)
+
+// the queue of Manager is persisted in this file under ManagerConfig.Dir,
+// the progress of each job is kept by its own meta file.
+const QUEUE_FILE = ".godl-queue.json"
+
+type JobState string
+
+const (
+	JOB_QUEUED JobState = "queued"
+	JOB_ACTIVE JobState = "active"
+	JOB_PAUSED JobState = "paused"
+	JOB_DONE   JobState = "done"
+	JOB_FAILED JobState = "failed"
+)
+
+// JobSpec describes a download submitted to Manager.
+type JobSpec struct {
+	// the first one is the primary source, the others are mirrors
+	Urls     []string `json:"urls"`
+	Dir      string   `json:"dir,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Headers  []string `json:"headers,omitempty"`
+	Checksum string   `json:"checksum,omitempty"`
+	MaxSpeed int64    `json:"max_speed,omitempty"`
+	Conn     int      `json:"conn,omitempty"`
+	// the jobs with higher priority are started first
+	Priority int `json:"priority,omitempty"`
+}
+
+type Job struct {
+	Id string `json:"id"`
+	JobSpec
+	State    JobState  `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	FileSize int64     `json:"file_size"`
+	Written  int64     `json:"written"`
+	Created  time.Time `json:"created"`
+
+	task   *DnTask
+	cancel context.CancelFunc
+	// the state after the task is stopped by manager, empty means the
+	// job is removed
+	stopTo *JobState
+}
+
+// JobStatus is a snapshot of a job.
+type JobStatus struct {
+	Job
+	Speed int64 `json:"speed"`
+	// the seconds remained at current speed, -1 means unknown
+	Eta int64 `json:"eta"`
+	// see Meta.BlockMap, only returned by Get
+	Blocks string `json:"blocks,omitempty"`
+}
+
+type ManagerConfig struct {
+	// the default dir of jobs, and where the queue is persisted
+	Dir       string
+	MaxActive int
+	BlockBit  uint
+	// the default connections of a job
+	Conn int
+	// the base config of tasks, Name, Headers, Checksum and MaxSpeed
+	// are overwritten by JobSpec, and Client by the access list
+	Task *TaskConfig
+	// the destinations of jobs, checked like the /proxy of the godl
+	// server, see accessList. The internal addresses are denied unless
+	// they are allowed.
+	Allow []string
+	Deny  []string
+}
+
+// Manager runs the queued jobs, at most MaxActive of them at the same time.
+// The queue survives restarts, and the jobs resume from their meta files.
+type Manager struct {
+	cfg    *ManagerConfig
+	jobs   map[string]*Job
+	client *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	sync.Mutex
+}
+
+func NewManager(cfg *ManagerConfig) (*Manager, error) {
+	if cfg.MaxActive <= 0 {
+		cfg.MaxActive = 1
+	}
+	if cfg.BlockBit == 0 {
+		cfg.BlockBit = 20
+	}
+	if cfg.Task == nil {
+		cfg.Task = new(TaskConfig)
+	}
+	client, err := newAccessClient(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	m := &Manager{
+		cfg:    cfg,
+		jobs:   make(map[string]*Job),
+		client: client,
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	if err := m.load(); err != nil {
+		return nil, logex.Trace(err)
+	}
+
+	m.Lock()
+	m.schedule()
+	m.Unlock()
+	return m, nil
+}
+
+func (m *Manager) queuePath() string {
+	return filepath.Join(m.cfg.Dir, QUEUE_FILE)
+}
+
+func (m *Manager) load() error {
+	f, err := os.Open(m.queuePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return logex.Trace(err)
+	}
+	defer f.Close()
+
+	var jobs []*Job
+	if err := json.NewDecoder(f).Decode(&jobs); err != nil {
+		return logex.Trace(err)
+	}
+	for _, job := range jobs {
+		if job.State == JOB_ACTIVE {
+			job.State = JOB_QUEUED
+		}
+		m.jobs[job.Id] = job
+	}
+	return nil
+}
+
+// must be called with lock held
+func (m *Manager) save() error {
+	jobs := m.sortedJobs()
+	tmp := m.queuePath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	err = json.NewEncoder(f).Encode(jobs)
+	f.Close()
+	if err != nil {
+		return logex.Trace(err)
+	}
+	return logex.Trace(os.Rename(tmp, m.queuePath()))
+}
+
+// ordered by priority and created time
+func (m *Manager) sortedJobs() []*Job {
+	jobs := make([]*Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if jobs[i].Priority != jobs[j].Priority {
+			return jobs[i].Priority > jobs[j].Priority
+		}
+		return jobs[i].Created.Before(jobs[j].Created)
+	})
+	return jobs
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Add queues a job.
+func (m *Manager) Add(spec *JobSpec) (*JobStatus, error) {
+	if len(spec.Urls) == 0 || spec.Urls[0] == "" {
+		return nil, logex.NewError("url is empty")
+	}
+	for _, u := range spec.Urls {
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return nil, logex.NewError("unsupported url:", u)
+		}
+	}
+	if spec.Checksum != "" {
+		if _, err := ParseChecksum(spec.Checksum); err != nil {
+			return nil, logex.Trace(err)
+		}
+	}
+	dir, err := m.jobDir(spec.Dir, spec.Name)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	job := &Job{
+		Id:      newJobId(),
+		JobSpec: *spec,
+		State:   JOB_QUEUED,
+		Created: time.Now(),
+	}
+	job.Dir = dir
+
+	m.Lock()
+	defer m.Unlock()
+	// the jobs of the same target share the part and meta file
+	target := job.targetPath()
+	for _, other := range m.jobs {
+		if other.State != JOB_DONE && target != "" && other.targetPath() == target {
+			return nil, logex.NewError("the target is owned by job", other.Id+":", target)
+		}
+	}
+	m.jobs[job.Id] = job
+	if err := m.save(); err != nil {
+		logex.Error(err)
+	}
+	m.schedule()
+	return m.status(job), nil
+}
+
+// targetPath returns where the job is downloaded to, the name is guessed
+// from the url before the task is started.
+func (job *Job) targetPath() string {
+	if job.Path != "" {
+		return job.Path
+	}
+	name := job.Name
+	if name == "" {
+		u, err := url.Parse(job.Urls[0])
+		if err != nil {
+			return ""
+		}
+		name = path.Base(u.Path)
+	}
+	return filepath.Join(job.Dir, name)
+}
+
+// jobDir returns the dir of job under the Dir of manager, the absolute
+// paths and the ones escaping from it are refused.
+func (m *Manager) jobDir(dir, name string) (string, error) {
+	if filepath.IsAbs(dir) {
+		return "", logex.NewError("absolute dir is not allowed:", dir)
+	}
+	if name != "" && (name != filepath.Base(name) || name == "." || name == "..") {
+		return "", logex.NewError("invalid name:", name)
+	}
+	p := filepath.Join(m.cfg.Dir, dir)
+	rel, err := filepath.Rel(filepath.Clean(m.cfg.Dir), p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", logex.NewError("dir is out of", m.cfg.Dir+":", dir)
+	}
+	return p, nil
+}
+
+func (m *Manager) Get(id string) (*JobStatus, error) {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	s := m.status(job)
+	if job.task != nil {
+		s.Blocks = string(job.task.Meta.BlockMap())
+	}
+	return s, nil
+}
+
+// Jobs returns the snapshot of all jobs ordered by priority.
+func (m *Manager) Jobs() []*JobStatus {
+	m.Lock()
+	defer m.Unlock()
+	jobs := m.sortedJobs()
+	ret := make([]*JobStatus, len(jobs))
+	for i, job := range jobs {
+		ret[i] = m.status(job)
+	}
+	return ret
+}
+
+// must be called with lock held
+func (m *Manager) status(job *Job) *JobStatus {
+	s := &JobStatus{Job: *job}
+	if job.task != nil {
+		s.Written = job.task.Written()
+		s.FileSize = job.task.Meta.FileSize
+		s.Speed = job.task.Speed()
+	}
+	s.Eta = -1
+	switch {
+	case s.State == JOB_DONE:
+		s.Eta = 0
+	case s.Speed > 0 && s.FileSize > 0:
+		s.Eta = (s.FileSize - s.Written) / s.Speed
+	}
+	return s
+}
+
+var ErrJobNotFound = logex.NewError("job not found")
+
+// Pause stops an active or queued job, the progress is kept.
+func (m *Manager) Pause(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	switch job.State {
+	case JOB_QUEUED:
+		job.State = JOB_PAUSED
+	case JOB_ACTIVE:
+		m.stop(job, JOB_PAUSED)
+	default:
+		return logex.NewError("can't pause a", job.State, "job")
+	}
+	return logex.Trace(m.save())
+}
+
+// Resume queues a paused or failed job again.
+func (m *Manager) Resume(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	switch job.State {
+	case JOB_PAUSED, JOB_FAILED:
+		job.State = JOB_QUEUED
+		job.Error = ""
+	case JOB_ACTIVE:
+		if job.stopTo != nil && *job.stopTo == JOB_PAUSED {
+			// it's pausing, queue it again when the task exits
+			queued := JOB_QUEUED
+			job.stopTo = &queued
+		}
+		return nil
+	case JOB_QUEUED:
+		return nil
+	default:
+		return logex.NewError("can't resume a", job.State, "job")
+	}
+	m.schedule()
+	return logex.Trace(m.save())
+}
+
+// Remove cancels the job and removes it from the queue. The partial file
+// and its meta are deleted if the job is not done.
+func (m *Manager) Remove(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if job.State == JOB_ACTIVE {
+		// cleaned up when the task exits
+		m.stop(job, "")
+		return nil
+	}
+	m.remove(job)
+	return logex.Trace(m.save())
+}
+
+// SetMaxSpeed changes the speed limit of a job, 0 means the default one.
+func (m *Manager) SetMaxSpeed(id string, max int64) error {
+	m.Lock()
+	defer m.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	job.MaxSpeed = max
+	if job.task != nil {
+		job.task.SetMaxSpeed(m.taskConfig(job).MaxSpeed)
+	}
+	return logex.Trace(m.save())
+}
+
+// must be called with lock held
+func (m *Manager) remove(job *Job) {
+	delete(m.jobs, job.Id)
+	if job.State != JOB_DONE && job.Path != "" {
+		os.Remove(job.Path + PART_EXT)
+		os.Remove(job.Path + META_EXT)
+	}
+}
+
+// must be called with lock held
+func (m *Manager) stop(job *Job, to JobState) {
+	job.stopTo = &to
+	job.cancel()
+}
+
+// start the queued jobs, must be called with lock held
+func (m *Manager) schedule() {
+	if m.ctx.Err() != nil {
+		return
+	}
+	active := 0
+	for _, job := range m.jobs {
+		if job.State == JOB_ACTIVE {
+			active++
+		}
+	}
+	for _, job := range m.sortedJobs() {
+		if active >= m.cfg.MaxActive {
+			break
+		}
+		if job.State != JOB_QUEUED {
+			continue
+		}
+		job.State = JOB_ACTIVE
+		job.stopTo = nil
+		var ctx context.Context
+		ctx, job.cancel = context.WithCancel(m.ctx)
+		active++
+		m.wg.Add(1)
+		go m.run(ctx, job)
+	}
+}
+
+func (m *Manager) taskConfig(job *Job) *TaskConfig {
+	cfg := *m.cfg.Task
+	cfg.Progress = false
+	cfg.Clean = false
+	cfg.Name = job.Name
+	cfg.Checksum = job.Checksum
+	cfg.Headers = append(append([]string(nil), cfg.Headers...), job.Headers...)
+	cfg.Client = m.client
+	if job.MaxSpeed > 0 {
+		cfg.MaxSpeed = job.MaxSpeed
+	}
+	return &cfg
+}
+
+func (m *Manager) newTask(job *Job) (*DnTask, error) {
+	if err := os.MkdirAll(job.Dir, 0755); err != nil {
+		return nil, logex.Trace(err)
+	}
+	if len(job.Urls) > 1 {
+		return NewDnTaskMirrors(job.Urls, job.Dir, m.cfg.BlockBit, m.taskConfig(job))
+	}
+	return NewDnTaskAuto(job.Urls[0], job.Dir, m.cfg.BlockBit, m.taskConfig(job))
+}
+
+func (m *Manager) run(ctx context.Context, job *Job) {
+	defer m.wg.Done()
+
+	task, err := m.newTask(job)
+	if err == nil {
+		m.Lock()
+		job.task = task
+		job.Path = task.Meta.TargetPath()
+		job.FileSize = task.Meta.FileSize
+		m.Unlock()
+
+		conn := job.Conn
+		if conn == 0 {
+			conn = m.cfg.Conn
+		}
+		err = task.ScheduleContext(ctx, conn)
+		task.Close()
+		if task.Meta.IsFinish() && err == nil {
+			task.Meta.Remove()
+		} else {
+			task.Meta.Sync()
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if task != nil {
+		job.Written = task.Written()
+		job.task = nil
+	}
+	switch {
+	case job.stopTo != nil:
+		job.State = *job.stopTo
+	case m.ctx.Err() != nil:
+		// the manager is closed, resume at next start
+		job.State = JOB_QUEUED
+	case err != nil:
+		job.State = JOB_FAILED
+		job.Error = err.Error()
+		logex.Error("job", job.Id, "failed:", err)
+	default:
+		job.State = JOB_DONE
+		logex.Info("job", job.Id, "done:", job.Path)
+	}
+	if job.State == "" {
+		m.remove(job)
+	}
+	if err := m.save(); err != nil {
+		logex.Error(err)
+	}
+	m.schedule()
+}
+
+// Close stops all the active jobs, they are resumed when the Manager is
+// created again with the same Dir.
+func (m *Manager) Close() error {
+	m.cancel()
+	m.wg.Wait()
+	m.Lock()
+	defer m.Unlock()
+	return logex.Trace(m.save())
+}
@@ -0,0 +1,100 @@
+package godl
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestOrigin(t *testing.T, data []byte, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		http.ServeContent(w, r, "f", time.Unix(1000, 0), bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func waitJob(t *testing.T, m *Manager, id string, state JobState) *JobStatus {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		s, err := m.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.State == state {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("job", id, "is not", state)
+	return nil
+}
+
+func TestManagerResumePausing(t *testing.T) {
+	origin := newTestOrigin(t, bytes.Repeat([]byte("godl"), 1<<18), 50*time.Millisecond)
+	m, err := NewManager(&ManagerConfig{
+		Dir:       t.TempDir(),
+		MaxActive: 1,
+		BlockBit:  16,
+		Conn:      2,
+		Task:      new(TaskConfig),
+		Allow:     []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	s, err := m.Add(&JobSpec{Urls: []string{origin.URL + "/f"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, m, s.Id, JOB_ACTIVE)
+	if err := m.Pause(s.Id); err != nil {
+		t.Fatal(err)
+	}
+	// the task is still stopping
+	if err := m.Resume(s.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitJob(t, m, s.Id, JOB_DONE)
+}
+
+func TestManagerSameTarget(t *testing.T) {
+	origin := newTestOrigin(t, bytes.Repeat([]byte("godl"), 1<<16), 20*time.Millisecond)
+	m := newTestManager(t, []string{"127.0.0.1"})
+
+	s, err := m.Add(&JobSpec{Urls: []string{origin.URL + "/f"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []*JobSpec{
+		{Urls: []string{origin.URL + "/f"}},
+		{Urls: []string{origin.URL + "/x/f?a=b"}},
+		{Urls: []string{origin.URL + "/g"}, Name: "f"},
+		{Urls: []string{origin.URL + "/f"}, Dir: "a/.."},
+	} {
+		if _, err := m.Add(spec); err == nil {
+			t.Fatal("the same target is accepted:", spec.Urls, spec.Dir, spec.Name)
+		}
+	}
+	for _, spec := range []*JobSpec{
+		{Urls: []string{origin.URL + "/f"}, Name: "g"},
+		{Urls: []string{origin.URL + "/f"}, Dir: "sub"},
+	} {
+		other, err := m.Add(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitJob(t, m, other.Id, JOB_DONE)
+	}
+
+	// the target is released once it's done
+	waitJob(t, m, s.Id, JOB_DONE)
+	if _, err := m.Add(&JobSpec{Urls: []string{origin.URL + "/f"}}); err != nil {
+		t.Fatal(err)
+	}
+}
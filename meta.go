@@ -1,12 +1,15 @@
-package main
+package godl
 
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -28,8 +31,17 @@ const (
 	H_CONTENT_DISPOSITION = "Content-Disposition"
 	H_RANGE               = "Range"
 	H_SOURCE              = "X-Source"
+	H_LAST_MODIFIED       = "Last-Modified"
+	H_IF_RANGE            = "If-Range"
+	H_CONTENT_RANGE       = "Content-Range"
 )
 
+const META_EXT = ".godl"
+
+// the file is downloaded to the path with PART_EXT, and moved to the
+// target after it's finished and verified.
+const PART_EXT = ".part"
+
 type Meta struct {
 	Pwd      string
 	Name     string
@@ -40,9 +52,16 @@ type Meta struct {
 	BlkBit   uint
 	BlkSize  int
 	Blocks   Blocks
+	// the other sources of the same file
+	Mirrors []string
+	// validates the file on server with Etag when resuming
+	LastModified string
 
-	header  http.Header
-	written int64
+	header    http.Header
+	written   int64
+	fixedName bool
+	// the client to the sources, DefaultClient if nil
+	client *http.Client
 
 	file *os.File
 	enc  *json.Encoder
@@ -53,6 +72,15 @@ func (m *Meta) CopyFrom(mm *Meta) {
 	m.file = mm.file
 	m.enc = mm.enc
 	m.header = mm.header
+	m.fixedName = mm.fixedName
+	m.client = mm.client
+}
+
+func (m *Meta) httpClient() *http.Client {
+	if m.client != nil {
+		return m.client
+	}
+	return DefaultClient
 }
 
 type Blocks []*Block
@@ -75,6 +103,11 @@ func NewMetaFormFile(target string) (*Meta, error) {
 }
 
 func NewMeta(pwd, endPoint string, bit uint, cln bool) (*Meta, error) {
+	return newMeta(pwd, "", endPoint, bit, cln)
+}
+
+// the name is guessed from the url and Content-Disposition if it's empty
+func newMeta(pwd, name, endPoint string, bit uint, cln bool) (*Meta, error) {
 	u, _ := url.Parse(endPoint)
 
 	m := &Meta{
@@ -85,6 +118,10 @@ func NewMeta(pwd, endPoint string, bit uint, cln bool) (*Meta, error) {
 		BlkBit:   bit,
 		BlkSize:  1 << bit,
 	}
+	if name != "" {
+		m.Name = filepath.Base(name)
+		m.fixedName = true
+	}
 	if err := m.openFile(cln); err != nil {
 		return nil, logex.Trace(err)
 	}
@@ -100,6 +137,11 @@ func (m *Meta) IsAccpetRange() bool {
 	return false
 }
 
+// Digests returns the checksums of the file provided by the server.
+func (m *Meta) Digests() []*Checksum {
+	return parseDigestHeader(m.header)
+}
+
 func (m *Meta) openFile(cln bool) error {
 	if m.file != nil {
 		m.file.Close()
@@ -118,14 +160,80 @@ func (m *Meta) openFile(cln bool) error {
 	return nil
 }
 
+// Pretty prints the meta without the response header and the blocks
+// which are never allocated.
+func (m *Meta) Pretty() {
+	m.header = nil
+	for i := range m.Blocks {
+		if m.Blocks[i] == nil {
+			m.Blocks = m.Blocks[:i]
+			break
+		}
+	}
+	logex.Pretty(m)
+}
+
+// BlockMap returns the progress of blocks, one byte for each: '.' is not
+// started, '>' is downloading and '#' is finished.
+func (m *Meta) BlockMap() []byte {
+	m.Lock()
+	defer m.Unlock()
+	ret := make([]byte, len(m.Blocks))
+	for i, head := range m.Blocks {
+		ret[i] = '.'
+		if head == nil {
+			continue
+		}
+		fin := true
+		for _, blk := range head.spans() {
+			if blk.State != STATE_FIN {
+				fin = false
+			}
+			if blk.State == STATE_PROCESS || blk.Written > 0 {
+				ret[i] = '>'
+			}
+		}
+		if fin {
+			ret[i] = '#'
+		}
+	}
+	return ret
+}
+
 func (m *Meta) Close() error {
 	return m.file.Close()
 }
 
-func (m *Meta) targetPath() string {
+func (m *Meta) TargetPath() string {
 	return filepath.Join(m.Pwd, m.Name)
 }
 
+func (m *Meta) PartPath() string {
+	return filepath.Join(m.Pwd, m.Name+PART_EXT)
+}
+
+// dataPath returns where the data is, the part file if it's downloading,
+// otherwise the target.
+func (m *Meta) dataPath() string {
+	if _, err := os.Stat(m.PartPath()); err == nil {
+		return m.PartPath()
+	}
+	return m.TargetPath()
+}
+
+// adoptTarget moves the target to the part file, it's partially downloaded
+// by an older godl in place.
+func (m *Meta) adoptTarget() error {
+	if _, err := os.Stat(m.PartPath()); !os.IsNotExist(err) {
+		return nil
+	}
+	err := os.Rename(m.TargetPath(), m.PartPath())
+	if err != nil && !os.IsNotExist(err) {
+		return logex.Trace(err)
+	}
+	return nil
+}
+
 func (m *Meta) parseDisposition(dispositions []string) {
 	prefix := `filename=`
 	for _, d := range dispositions {
@@ -149,12 +257,19 @@ func (m *Meta) parseDisposition(dispositions []string) {
 		if urlDecode, err := url.QueryUnescape(fileName); err == nil {
 			fileName = urlDecode
 		}
+		// never out of the dir
+		fileName = filepath.Base(strings.Replace(fileName, `\`, "/", -1))
+		if fileName == "." || fileName == ".." || fileName == "/" {
+			continue
+		}
 		m.Name = fileName
 		return
 	}
 }
 
-func (m *Meta) headReq(proxy []string) (*http.Response, error) {
+// proxyClient is used to connect the godl proxies, the headers are sent to
+// the source
+func (m *Meta) headReq(proxy []string, proxyClient *http.Client, headers []string) (*http.Response, error) {
 	var ret *http.Response
 	var mutex sync.Mutex
 	var errInfo []string
@@ -163,12 +278,24 @@ func (m *Meta) headReq(proxy []string) (*http.Response, error) {
 		i := i
 		go func() {
 			var resp *http.Response
+			var req *http.Request
 			var err error
 			if i == -1 {
-				resp, err = http.Head(m.Source)
+				if req, err = http.NewRequest("HEAD", m.Source, nil); err == nil {
+					setHeaders(req.Header, headers)
+					resp, err = m.httpClient().Do(req)
+				}
 			} else {
-				resp, err = http.Head(proxyUrl(proxy[i], m.Source, -1, -1))
-				if resp != nil {
+				req, err = newProxyRequest(context.Background(), "HEAD", proxy[i], m.Source, -1, -1, headers)
+				if err == nil {
+					resp, err = proxyClient.Do(req)
+				}
+				if err == nil && resp.StatusCode >= 400 {
+					// refused by the proxy, or the source through it
+					err = newStatusError(resp)
+					resp.Body.Close()
+				}
+				if err == nil {
 					resp.Request.URL, _ = url.Parse(resp.Header.Get(H_SOURCE))
 				}
 			}
@@ -198,10 +325,22 @@ func (m *Meta) headReq(proxy []string) (*http.Response, error) {
 	return nil, errors.New(strings.Join(errInfo, ";"))
 }
 
-func (m *Meta) retrieveFromHead(proxy []string) error {
-	resp, err := m.headReq(proxy)
-	if err != nil {
-		return logex.Trace(err)
+func (m *Meta) retrieveFromHead(proxy []string, proxyClient *http.Client, headers []string) error {
+	resp, err := m.headReq(proxy, proxyClient, headers)
+	if err != nil || resp.StatusCode/100 != 2 || resp.Header.Get(H_ACCEPT_RANGES) != "bytes" {
+		probe, probeErr := m.probeRange(proxy, proxyClient, headers)
+		switch {
+		case probeErr == nil:
+			resp, err = probe, nil
+		case err != nil:
+			return logex.Trace(err, probeErr.Error())
+		case resp.StatusCode/100 != 2:
+			// never take the error page as the file
+			resp.Body.Close()
+			return logex.Trace(newStatusError(resp), probeErr.Error())
+		default:
+			logex.Debug("probe range error:", probeErr)
+		}
 	}
 	m.header = resp.Header
 	m.Source = resp.Request.URL.String()
@@ -217,19 +356,103 @@ func (m *Meta) retrieveFromHead(proxy []string) error {
 		}
 	}
 
-	m.parseDisposition(m.header[H_CONTENT_DISPOSITION])
+	if !m.fixedName {
+		m.parseDisposition(m.header[H_CONTENT_DISPOSITION])
+	}
 	m.Etag = m.header.Get(H_ETAG)
+	m.LastModified = m.header.Get(H_LAST_MODIFIED)
 	return nil
 }
 
-func (m *Meta) retrieveFromDisk(proxy []string) (err error) {
+// probeRange gets the first byte of source to learn the size and the range
+// support, for the servers rejecting HEAD or omitting Accept-Ranges. It's
+// tried directly and then by the proxies in order. The body is drained, so
+// the connection is reused by the first block.
+func (m *Meta) probeRange(proxy []string, proxyClient *http.Client, headers []string) (*http.Response, error) {
+	var errInfo []string
+	for i := -1; i < len(proxy); i++ {
+		var req *http.Request
+		var err error
+		client := m.httpClient()
+		if i == -1 {
+			if req, err = http.NewRequest("GET", m.Source, nil); err == nil {
+				setHeaders(req.Header, headers)
+				setRange(req.Header, 0, 1)
+			}
+		} else {
+			req, err = newProxyRequest(context.Background(), "GET", proxy[i], m.Source, 0, 1, headers)
+			client = proxyClient
+		}
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		resp, err := m.probeResp(client, req, i >= 0)
+		if err == nil {
+			return resp, nil
+		}
+		errInfo = append(errInfo, err.Error())
+	}
+	return nil, logex.NewError(strings.Join(errInfo, "\n"))
+}
+
+func (m *Meta) probeResp(client *http.Client, req *http.Request, proxied bool) (*http.Response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if proxied {
+		resp.Request.URL, _ = url.Parse(resp.Header.Get(H_SOURCE))
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		// the body is the whole file, it's not worth to keep
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return nil, newStatusError(resp)
+		}
+		resp.Header.Del(H_ACCEPT_RANGES)
+		if resp.ContentLength >= 0 {
+			resp.Header.Set(H_CONTENT_LENGTH, strconv.FormatInt(resp.ContentLength, 10))
+		}
+		return resp, nil
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<10))
+	resp.Body.Close()
+	size, err := parseContentRangeSize(resp.Header.Get(H_CONTENT_RANGE))
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	resp.Header.Set(H_CONTENT_LENGTH, strconv.FormatInt(size, 10))
+	resp.Header.Set(H_ACCEPT_RANGES, "bytes")
+	// they may be the digests of the range, Repr-Digest is always of
+	// the whole file
+	resp.Header.Del(H_CONTENT_MD5)
+	resp.Header.Del(H_DIGEST)
+	return resp, nil
+}
+
+// parseContentRangeSize returns the complete length in "bytes 0-0/1234"
+func parseContentRangeSize(cr string) (int64, error) {
+	idx := strings.LastIndex(cr, "/")
+	if !strings.HasPrefix(cr, "bytes ") || idx < 0 {
+		return 0, logex.NewError("invalid Content-Range:", cr)
+	}
+	size, err := strconv.ParseInt(cr[idx+1:], 10, 64)
+	if err != nil {
+		return 0, logex.NewError("unknown size in Content-Range:", cr)
+	}
+	return size, nil
+}
+
+func (m *Meta) retrieveFromDisk(proxy []string, proxyClient *http.Client, headers []string) (err error) {
 	if m.header == nil {
-		if err = m.retrieveFromHead(proxy); err != nil {
+		if err = m.retrieveFromHead(proxy, proxyClient, headers); err != nil {
 			return logex.Trace(err)
 		}
 	}
 
-	if !m.IsAccpetRange() {
+	if m.FileSize <= 0 {
+		// the stream of unknown size can't be resumed
 		return nil
 	}
 
@@ -242,10 +465,7 @@ func (m *Meta) retrieveFromDisk(proxy []string) (err error) {
 	}
 	defer f.Close()
 
-	diskMeta, err := NewMeta(m.Pwd, m.EndPoint, m.BlkBit, false)
-	if err != nil {
-		panic(err)
-	}
+	diskMeta := &Meta{Pwd: m.Pwd, EndPoint: m.EndPoint, BlkBit: m.BlkBit}
 	if err := diskMeta.Decode(f); err != nil {
 		if logex.Equal(err, io.EOF) {
 			err = nil
@@ -257,17 +477,59 @@ func (m *Meta) retrieveFromDisk(proxy []string) (err error) {
 		logex.Info("blksize change to", diskMeta.BlkBit)
 	}
 
-	if diskMeta.Etag != m.Etag {
-		logex.Info("etag not matched, redownload", diskMeta.Etag, m.Etag)
+	if reason := m.changedFrom(diskMeta); reason != "" {
+		logex.Info(reason + ", redownload")
+		if err := os.Truncate(m.PartPath(), 0); err != nil && !os.IsNotExist(err) {
+			return logex.Trace(err)
+		}
 		return nil
 	}
 
-	diskMeta.CopyFrom(m)
-	diskMeta.BlkSize = 1 << diskMeta.BlkBit
-	*m = *diskMeta
+	// only the progress is taken, the validators of server are fresher
+	m.Lock()
+	m.BlkBit = diskMeta.BlkBit
+	m.BlkSize = 1 << diskMeta.BlkBit
+	m.Blocks = diskMeta.Blocks
+	atomic.StoreInt64(&m.written, atomic.LoadInt64(&diskMeta.written))
+	m.Unlock()
+	if atomic.LoadInt64(&m.written) > 0 {
+		return logex.Trace(m.adoptTarget())
+	}
 	return nil
 }
 
+// changedFrom tells why the file on server is not the one in disk meta,
+// empty if it's not changed or it can't be told. The Last-Modified is
+// compared only if both of them have, for the journals of older godl.
+func (m *Meta) changedFrom(disk *Meta) string {
+	switch {
+	case disk.FileSize != m.FileSize:
+		return fmt.Sprint("size not matched: ", disk.FileSize, " ", m.FileSize)
+	case disk.Etag != m.Etag:
+		return fmt.Sprint("etag not matched: ", disk.Etag, " ", m.Etag)
+	case disk.LastModified != "" && m.LastModified != "" &&
+		disk.LastModified != m.LastModified:
+		return fmt.Sprint("last-modified not matched: ", disk.LastModified, " ", m.LastModified)
+	}
+	return ""
+}
+
+// ifRange returns the validator of If-Range, the weak etag can't be used.
+func (m *Meta) ifRange() string {
+	if m.Etag != "" && !strings.HasPrefix(m.Etag, "W/") {
+		return m.Etag
+	}
+	return m.LastModified
+}
+
+// reset drops all the progress.
+func (m *Meta) reset() {
+	m.Lock()
+	m.Blocks = make([]*Block, m.BlkCnt())
+	atomic.StoreInt64(&m.written, 0)
+	m.Unlock()
+}
+
 func (m *Meta) Remove() error {
 	return logex.Trace(os.Remove(m.getDiskPath()))
 }
@@ -297,7 +559,11 @@ func (m *Meta) Sync() error {
 }
 
 func (m *Meta) getDiskPath() string {
-	return filepath.Join(m.Pwd, fmt.Sprintf("%v.godl", m.Name))
+	return filepath.Join(m.Pwd, m.Name+META_EXT)
+}
+
+func isMetaPath(p string) bool {
+	return strings.HasSuffix(p, META_EXT)
 }
 
 func (m *Meta) setFileSize(size int64) *Meta {
@@ -312,9 +578,22 @@ const (
 	STATE_FIN
 )
 
+var blkHashTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Block is the progress of a block. Once an idle connection steals the tail
+// of a block, the block is split into parts, each part is downloaded by one
+// connection and tracked like a block.
 type Block struct {
 	State   int
 	Written int
+	// crc32c of the written bytes, zero means unknown
+	Hash uint32
+
+	// [Start, End) of a part relative to the block offset, a zero End
+	// means the end of block
+	Start int
+	End   int
+	Parts []*Block
 }
 
 func (b *Block) markFinish(written, max int) (change int64) {
@@ -332,13 +611,39 @@ func (b *Block) markFinish(written, max int) (change int64) {
 	return change
 }
 
+// must be called before the Written is changed
+func (b *Block) updateHash(buf []byte) {
+	if b.Written > 0 && b.Hash == 0 {
+		// resumed from a journal without hash
+		return
+	}
+	b.Hash = crc32.Update(b.Hash, blkHashTable, buf)
+}
+
+// the block itself and its parts
+func (b *Block) spans() []*Block {
+	return append([]*Block{b}, b.Parts...)
+}
+
+func (b *Block) findPart(start int) *Block {
+	for _, p := range b.Parts {
+		if p.Start == start {
+			return p
+		}
+	}
+	return nil
+}
+
 func NewBlock() *Block {
 	return new(Block)
 }
 
 type BlkOff struct {
-	Offset  int `json:"o"`
-	Written int `json:"w"`
+	Offset  int    `json:"o"`
+	Written int    `json:"w"`
+	Hash    uint32 `json:"h,omitempty"`
+	Start   int    `json:"s,omitempty"`
+	End     int    `json:"e,omitempty"`
 }
 
 func (m *Meta) BlkCnt() int {
@@ -349,6 +654,126 @@ func (m *Meta) BlkCnt() int {
 	return int(cnt) + 1
 }
 
+// the size of block idx
+func (m *Meta) blkLen(idx int) int {
+	leave := m.FileSize - int64(idx<<m.BlkBit)
+	if leave < int64(m.BlkSize) {
+		return int(leave)
+	}
+	return m.BlkSize
+}
+
+// the end of the block or part relative to the block offset
+func (m *Meta) spanEnd(idx int, b *Block) int {
+	if b.End > 0 {
+		return b.End
+	}
+	return m.blkLen(idx)
+}
+
+// SpanRange is the range of the block or part which is not written,
+// relative to the block offset.
+func (m *Meta) SpanRange(idx int, b *Block) (start, end int) {
+	m.Lock()
+	defer m.Unlock()
+	return b.Start + b.Written, m.spanEnd(idx, b)
+}
+
+// allocBlock hands out the first block or part in STATE_INIT from off. If
+// there is none, the largest unfinished remainder in progress which is not
+// smaller than minSteal is split, and its second half is handed out.
+func (m *Meta) allocBlock(off, minSteal int) (int, *Block) {
+	m.Lock()
+	defer m.Unlock()
+
+	// wrap around to pick up the blocks given back by others
+	for j := 0; j < len(m.Blocks); j++ {
+		i := (off + j) % len(m.Blocks)
+		head := m.Blocks[i]
+		if head == nil {
+			head = NewBlock()
+			m.Blocks[i] = head
+		}
+		for _, blk := range head.spans() {
+			if blk.State != STATE_INIT {
+				continue
+			}
+			blk.State = STATE_PROCESS
+			return i, blk
+		}
+	}
+
+	var (
+		idx    = -1
+		victim *Block
+		remain int
+	)
+	for i, head := range m.Blocks {
+		if head == nil {
+			continue
+		}
+		for _, blk := range head.spans() {
+			if blk.State != STATE_PROCESS {
+				continue
+			}
+			r := m.spanEnd(i, blk) - blk.Start - blk.Written
+			if r > remain {
+				idx, victim, remain = i, blk, r
+			}
+		}
+	}
+	if victim == nil || remain < minSteal {
+		return -1, nil
+	}
+	part, err := m.splitBlock(idx, victim, remain/2)
+	if err != nil {
+		logex.Error(err)
+	}
+	part.State = STATE_PROCESS
+	return idx, part
+}
+
+// splitBlock cuts the last n bytes of b into a new part of block idx.
+func (m *Meta) splitBlock(idx int, b *Block, n int) (*Block, error) {
+	end := m.spanEnd(idx, b)
+	part := &Block{Start: end - n, End: end}
+	b.End = part.Start
+	head := m.Blocks[idx]
+	head.Parts = append(head.Parts, part)
+
+	// b must be journaled first, a crash between them leaves the
+	// stolen part unrecorded and it will be downloaded by b again.
+	if err := m.writeBlock(nil, nil, idx, b); err != nil {
+		return part, logex.Trace(err)
+	}
+	return part, logex.Trace(m.writeBlock(nil, nil, idx, part))
+}
+
+// MetaExt holds the header fields added after the format of journal is
+// fixed. It's encoded as {"x":{...}} after the headers, which is taken as an
+// empty block by the older godl.
+type MetaExt struct {
+	Mirrors      []string `json:"mirrors,omitempty"`
+	LastModified string   `json:"last_modified,omitempty"`
+}
+
+type metaLine struct {
+	BlkOff
+	Ext *MetaExt `json:"x,omitempty"`
+}
+
+func (m *Meta) ext() *MetaExt {
+	return &MetaExt{
+		Mirrors:      m.Mirrors,
+		LastModified: m.LastModified,
+	}
+}
+
+func (m *Meta) setExt(ext *MetaExt) {
+	m.Mirrors = ext.Mirrors
+	m.LastModified = ext.LastModified
+}
+
 func (m *Meta) headers() []interface{} {
 	return []interface{}{
 		&m.Pwd, &m.Name, &m.Etag, &m.Source,
@@ -364,34 +789,47 @@ func (m *Meta) Decode(r io.Reader) error {
 			return logex.Trace(err)
 		}
 	}
+	m.BlkSize = 1 << m.BlkBit
 	cnt := m.BlkCnt()
 	m.Blocks = make([]*Block, cnt)
-	blkoff := new(BlkOff)
+	line := new(metaLine)
+	blkoff := &line.BlkOff
 	for {
-		err := dec.Decode(&blkoff)
+		*line = metaLine{}
+		err := dec.Decode(line)
 		if err != nil {
 			if logex.Equal(err, io.EOF) {
 				break
 			}
 			return logex.Trace(err)
 		}
-		blk := &Block{
-			Written: blkoff.Written,
+		if line.Ext != nil {
+			m.setExt(line.Ext)
+			continue
 		}
-		if blk.Written == m.BlkSize {
-			blk.State = STATE_FIN
+		head := m.Blocks[blkoff.Offset]
+		if head == nil {
+			head = NewBlock()
+			m.Blocks[blkoff.Offset] = head
 		}
-		oldblk := m.Blocks[blkoff.Offset]
-		m.Blocks[blkoff.Offset] = blk
-		if oldblk != nil {
-			atomic.AddInt64(&m.written, int64(blk.Written-oldblk.Written))
-		} else {
-			atomic.AddInt64(&m.written, int64(blk.Written))
+		blk := head
+		if blkoff.Start > 0 {
+			if blk = head.findPart(blkoff.Start); blk == nil {
+				blk = &Block{Start: blkoff.Start}
+				head.Parts = append(head.Parts, blk)
+			}
 		}
+		atomic.AddInt64(&m.written, int64(blkoff.Written-blk.Written))
+		blk.Written = blkoff.Written
+		blk.Hash = blkoff.Hash
+		blk.End = blkoff.End
 	}
-	if blk := m.Blocks[len(m.Blocks)-1]; blk != nil {
-		if blk.State != STATE_FIN {
-			if int(m.FileSize&int64(m.BlkSize-1)) == blk.Written {
+	for i, head := range m.Blocks {
+		if head == nil {
+			continue
+		}
+		for _, blk := range head.spans() {
+			if blk.Written == m.spanEnd(i, blk)-blk.Start {
 				blk.State = STATE_FIN
 			}
 		}
@@ -399,7 +837,7 @@ func (m *Meta) Decode(r io.Reader) error {
 	return nil
 }
 
-func (m *Meta) writeBlock(enc *json.Encoder, blkoff *BlkOff, i int) error {
+func (m *Meta) writeBlock(enc *json.Encoder, blkoff *BlkOff, i int, blk *Block) error {
 	var buf *bytes.Buffer
 	if enc == nil {
 		buf = bytes.NewBuffer(nil)
@@ -409,7 +847,10 @@ func (m *Meta) writeBlock(enc *json.Encoder, blkoff *BlkOff, i int) error {
 		blkoff = new(BlkOff)
 	}
 	blkoff.Offset = i
-	blkoff.Written = m.Blocks[i].Written
+	blkoff.Written = blk.Written
+	blkoff.Hash = blk.Hash
+	blkoff.Start = blk.Start
+	blkoff.End = blk.End
 	if err := enc.Encode(blkoff); err != nil {
 		return logex.Trace(err)
 	}
@@ -430,13 +871,18 @@ func (m *Meta) Encode(w io.Writer) error {
 			return logex.Trace(err)
 		}
 	}
+	if err := enc.Encode(&metaLine{Ext: m.ext()}); err != nil {
+		return logex.Trace(err)
+	}
 	var blkoff BlkOff
 	for i := 0; i < len(m.Blocks); i++ {
 		if m.Blocks[i] == nil {
 			continue
 		}
-		if err := m.writeBlock(enc, &blkoff, i); err != nil {
-			return logex.Trace(err)
+		for _, blk := range m.Blocks[i].spans() {
+			if err := m.writeBlock(enc, &blkoff, i, blk); err != nil {
+				return logex.Trace(err)
+			}
 		}
 	}
 
@@ -448,42 +894,107 @@ func (m *Meta) MarkFinishStream(written int64) {
 	atomic.AddInt64(&m.written, written)
 }
 
+// MarkStream marks buf written by the stream which ends at off. If the size
+// is known, the progress is journaled by the blocks it covers.
+func (m *Meta) MarkStream(off int64, buf []byte) error {
+	if m.FileSize <= 0 {
+		m.MarkFinishStream(int64(len(buf)))
+		return nil
+	}
+	start := off - int64(len(buf))
+	for len(buf) > 0 {
+		idx := int(start >> m.BlkBit)
+		n := int64(m.BlkSize) - start&int64(m.BlkSize-1)
+		if n > int64(len(buf)) {
+			n = int64(len(buf))
+		}
+		m.Lock()
+		head := m.Blocks[idx]
+		if head == nil {
+			head = NewBlock()
+			m.Blocks[idx] = head
+		}
+		if head.State == STATE_INIT {
+			head.State = STATE_PROCESS
+		}
+		m.Unlock()
+		start += n
+		if err := m.MarkSpanByN(idx, head, start, buf[:n], true); err != nil {
+			return logex.Trace(err)
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
 func (m *Meta) MarkInit(idx int) {
-	m.Blocks[idx].Written = 0
-	m.Blocks[idx].State = STATE_INIT
+	m.MarkSpanInit(m.Blocks[idx])
+}
+
+// MarkBlockInit drops the written bytes of block idx and all its parts.
+func (m *Meta) MarkBlockInit(idx int) {
+	if m.Blocks[idx] == nil {
+		return
+	}
+	for _, blk := range m.Blocks[idx].spans() {
+		m.MarkSpanInit(blk)
+	}
+}
+
+// MarkSpanInit drops the written bytes of a block or a part of it.
+func (m *Meta) MarkSpanInit(blk *Block) {
+	m.Lock()
+	defer m.Unlock()
+	atomic.AddInt64(&m.written, -int64(blk.Written))
+	blk.Written = 0
+	blk.Hash = 0
+	blk.State = STATE_INIT
+}
+
+// MarkInterrupt gives the block back without dropping its written bytes.
+func (m *Meta) MarkInterrupt(blk *Block) {
+	m.Lock()
+	blk.State = STATE_INIT
+	m.Unlock()
 }
 
-func (m *Meta) MarkFinishByN(n int64, lastWritten int, flush bool) error {
+// n is the offset after buf is written, buf must not cross the blocks.
+func (m *Meta) MarkFinishByN(n int64, buf []byte, flush bool) error {
 	idx := int(n >> m.BlkBit)
-	written := int(n - int64(idx<<m.BlkBit))
-	if lastWritten > 0 && written == 0 {
+	if len(buf) > 0 && n == int64(idx<<m.BlkBit) {
 		idx--
-		written = m.BlkSize
 	}
+	return m.MarkSpanByN(idx, m.Blocks[idx], n, buf, flush)
+}
 
+// MarkSpanByN is like MarkFinishByN, but marks the block or the part blk of
+// the block idx.
+func (m *Meta) MarkSpanByN(idx int, blk *Block, n int64, buf []byte, flush bool) error {
+	m.Lock()
+	defer m.Unlock()
+	written := int(n-int64(idx<<m.BlkBit)) - blk.Start
 	if written == 0 {
-		logex.Error(idx, n, written, lastWritten, m.BlkSize)
+		logex.Error(idx, n, written, len(buf), m.BlkSize)
 	}
-
-	return m.MarkFinish(idx, written, flush)
+	blk.updateHash(buf)
+	return m.markSpan(idx, blk, written, flush)
 }
 
 func (m *Meta) MarkFinish(idx, written int, flush bool) error {
-	leave := m.FileSize - int64(idx<<m.BlkBit)
-	max := m.BlkSize
-	if leave < int64(m.BlkSize) {
-		max = int(leave)
-	}
-	change := m.Blocks[idx].markFinish(written, max)
+	m.Lock()
+	defer m.Unlock()
+	return m.markSpan(idx, m.Blocks[idx], written, flush)
+}
+
+func (m *Meta) markSpan(idx int, blk *Block, written int, flush bool) error {
+	max := m.spanEnd(idx, blk) - blk.Start
+	change := blk.markFinish(written, max)
 	if change < 0 {
-		panic(fmt.Sprintf(
-			"idx: %v",
-			idx,
-		))
+		return logex.NewError("block written decreased, idx:", idx)
 	}
 	atomic.AddInt64(&m.written, change)
 	if flush {
-		return logex.Trace(m.writeBlock(nil, nil, idx))
+		return logex.Trace(m.writeBlock(nil, nil, idx, blk))
 	}
 	return nil
 }
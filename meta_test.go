@@ -0,0 +1,218 @@
+package godl
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestMeta(t *testing.T, size int64) *Meta {
+	m, err := newMeta(t.TempDir(), "f", "http://example.com/f", 16, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.setFileSize(size)
+	if err := m.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return m
+}
+
+func TestAllocBlockSteal(t *testing.T) {
+	m := newTestMeta(t, 2<<16)
+	for i := 0; i < 2; i++ {
+		if idx, blk := m.allocBlock(0, 1<<10); idx != i || blk == nil {
+			t.Fatal("expect block", i, "got", idx)
+		}
+	}
+
+	// block 1 has the largest remainder
+	if err := m.MarkSpanByN(0, m.Blocks[0], 100, make([]byte, 100), true); err != nil {
+		t.Fatal(err)
+	}
+	idx, part := m.allocBlock(0, 1<<10)
+	if idx != 1 || part == nil {
+		t.Fatal("expect stealing block 1, got", idx)
+	}
+	if part.Start != 1<<15 || part.End != 1<<16 || m.Blocks[1].End != 1<<15 {
+		t.Fatal("unexpected split:", m.Blocks[1].End, part.Start, part.End)
+	}
+	if s, e := m.SpanRange(1, part); s != 1<<15 || e != 1<<16 {
+		t.Fatal("unexpected range of part:", s, e)
+	}
+
+	// the remainders are smaller than minSteal
+	if idx, blk := m.allocBlock(0, 1<<16); blk != nil {
+		t.Fatal("unexpected steal of block", idx)
+	}
+}
+
+func TestResumeAfterSteal(t *testing.T) {
+	m := newTestMeta(t, 2<<16+100)
+	for i := 0; i < 3; i++ {
+		m.allocBlock(0, 1<<10)
+	}
+	head0 := m.Blocks[0]
+	if err := m.MarkSpanByN(0, head0, 1000, bytes.Repeat([]byte("a"), 1000), true); err != nil {
+		t.Fatal(err)
+	}
+	idx, part := m.allocBlock(0, 1<<10)
+	if idx != 1 {
+		t.Fatal("expect stealing block 1, got", idx)
+	}
+	off := int64(1<<16 + part.Start + 500)
+	if err := m.MarkSpanByN(1, part, off, bytes.Repeat([]byte("b"), 500), true); err != nil {
+		t.Fatal(err)
+	}
+	head2 := m.Blocks[2]
+	if err := m.MarkSpanByN(2, head2, 2<<16+100, bytes.Repeat([]byte("c"), 100), true); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewMetaFormFile(m.getDiskPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.written != 1600 {
+		t.Fatal("written not restored:", r.written)
+	}
+	if r.Blocks[0].Written != 1000 || r.Blocks[0].State != STATE_INIT {
+		t.Fatal("block 0 is not restored:", r.Blocks[0].Written, r.Blocks[0].State)
+	}
+	if r.Blocks[2].State != STATE_FIN {
+		t.Fatal("block 2 is not finished")
+	}
+	head := r.Blocks[1]
+	if head.End != 1<<15 || len(head.Parts) != 1 {
+		t.Fatal("the split is not restored:", head.End, len(head.Parts))
+	}
+	p := head.Parts[0]
+	if p.Start != 1<<15 || p.End != 1<<16 || p.Written != 500 || p.Hash != part.Hash {
+		t.Fatal("the part is not restored:", p.Start, p.End, p.Written)
+	}
+
+	// the unfinished spans are handed out again from their written offset
+	want := []struct {
+		idx   int
+		blk   *Block
+		start int
+		end   int
+	}{
+		{0, r.Blocks[0], 1000, 1 << 16},
+		{1, head, 0, 1 << 15},
+		{1, p, 1<<15 + 500, 1 << 16},
+	}
+	for _, w := range want {
+		idx, blk := r.allocBlock(0, 1<<20)
+		if idx != w.idx || blk != w.blk {
+			t.Fatal("expect the span of block", w.idx, "got", idx)
+		}
+		if s, e := r.SpanRange(idx, blk); s != w.start || e != w.end {
+			t.Fatal("unexpected range of block", idx, s, e)
+		}
+	}
+	if idx, blk := r.allocBlock(0, 1<<20); blk != nil {
+		t.Fatal("unexpected span of block", idx)
+	}
+}
+
+func TestParseDispositionName(t *testing.T) {
+	for _, c := range []struct {
+		disposition string
+		name        string
+	}{
+		{`attachment; filename="a.iso"`, "a.iso"},
+		{`attachment; filename="../../etc/x"`, "x"},
+		{`attachment; filename=..%2F..%2Fx`, "x"},
+		{`attachment; filename=".."`, "f"},
+	} {
+		m := &Meta{Name: "f"}
+		m.parseDisposition([]string{c.disposition})
+		if m.Name != c.name {
+			t.Fatal(c.disposition, "expect", c.name, "got", m.Name)
+		}
+	}
+}
+
+// the journal of older godl has no Last-Modified
+func TestRetrieveFromDiskValidators(t *testing.T) {
+	var modified int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(H_ETAG, `"v1"`)
+		var mtime time.Time
+		if atomic.LoadInt32(&modified) == 1 {
+			mtime = time.Unix(1000, 0)
+		}
+		http.ServeContent(w, r, "f", mtime, bytes.NewReader(make([]byte, 1<<16)))
+	}))
+	defer origin.Close()
+	dir := t.TempDir()
+
+	task, err := NewDnTask(origin.URL+"/f", dir, 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, blk := task.Meta.allocBlock(0, 1<<10)
+	if err := task.Meta.MarkSpanByN(idx, blk, 100, make([]byte, 100), true); err != nil {
+		t.Fatal(err)
+	}
+	task.Close()
+	if task.Meta.LastModified != "" {
+		t.Fatal("unexpected Last-Modified:", task.Meta.LastModified)
+	}
+
+	atomic.StoreInt32(&modified, 1)
+	task, err = NewDnTask(origin.URL+"/f", dir, 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Close()
+	if task.Meta.written != 100 || task.Meta.Blocks[idx].Written != 100 {
+		t.Fatal("the progress is not resumed:", task.Meta.written)
+	}
+	if task.Meta.LastModified == "" || task.Meta.Etag != `"v1"` {
+		t.Fatal("the validators are dropped:", task.Meta.LastModified, task.Meta.Etag)
+	}
+}
+
+func TestRetrieveFromHeadError(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(H_CONTENT_DISPOSITION, `attachment; filename="error.html"`)
+		http.Error(w, "<html>method not allowed</html>", 405)
+	}))
+	defer origin.Close()
+	if _, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, nil); err == nil {
+		t.Fatal("the error page is taken as the file")
+	}
+}
+
+// the ranged probe of the servers rejecting HEAD
+func TestRetrieveFromProbe(t *testing.T) {
+	data := bytes.Repeat([]byte("godl"), 1<<12)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			http.Error(w, "method not allowed", 405)
+			return
+		}
+		// the digests of the range
+		w.Header().Set(H_CONTENT_MD5, "1B2M2Y8AsgTpgAmY7PhCfg==")
+		w.Header().Set(H_DIGEST, "md5=1B2M2Y8AsgTpgAmY7PhCfg==")
+		http.ServeContent(w, r, "f", time.Unix(1000, 0), bytes.NewReader(data))
+	}))
+	defer origin.Close()
+	task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Close()
+	if task.Meta.FileSize != int64(len(data)) || !task.Meta.IsAccpetRange() {
+		t.Fatal("unexpected probe:", task.Meta.FileSize, task.Meta.IsAccpetRange())
+	}
+	if digests := task.Meta.Digests(); len(digests) != 0 {
+		t.Fatal("the digests of the range are taken:", digests)
+	}
+}
@@ -0,0 +1,385 @@
+package godl
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/logex.v1"
+)
+
+const (
+	H_LINK = "Link"
+
+	MIME_METALINK4 = "application/metalink4+xml"
+	MIME_METALINK  = "application/metalink+xml"
+)
+
+// the max size of a metalink file
+const maxMetalinkSize = 16 << 20
+
+// Metalink is a metalink document, both RFC 5854 (.meta4) and the
+// metalink 3 (.metalink) are supported.
+type Metalink struct {
+	Files  []*MetalinkFile `xml:"file"`
+	Files3 []*MetalinkFile `xml:"files>file"`
+}
+
+type MetalinkFile struct {
+	Name   string          `xml:"name,attr"`
+	Size   int64           `xml:"size"`
+	Hashes []*MetalinkHash `xml:"hash"`
+	Pieces *MetalinkPieces `xml:"pieces"`
+	Urls   []*MetalinkUrl  `xml:"url"`
+
+	// metalink 3
+	Hashes3 []*MetalinkHash `xml:"verification>hash"`
+	Pieces3 *MetalinkPieces `xml:"verification>pieces"`
+	Urls3   []*MetalinkUrl  `xml:"resources>url"`
+}
+
+type MetalinkHash struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type MetalinkPieces struct {
+	Length int64    `xml:"length,attr"`
+	Type   string   `xml:"type,attr"`
+	Hashes []string `xml:"hash"`
+}
+
+type MetalinkUrl struct {
+	Location string `xml:"location,attr"`
+	// metalink 4, 1 is the most preferred
+	Priority int `xml:"priority,attr"`
+	// metalink 3, 100 is the most preferred
+	Preference int    `xml:"preference,attr"`
+	Url        string `xml:",chardata"`
+}
+
+func isMetalinkPath(p string) bool {
+	if idx := strings.IndexAny(p, "?#"); idx >= 0 {
+		p = p[:idx]
+	}
+	return strings.HasSuffix(p, ".meta4") || strings.HasSuffix(p, ".metalink")
+}
+
+// LoadMetalink reads the metalink from a local file or an url.
+func LoadMetalink(source string, headers []string) (*Metalink, error) {
+	return loadMetalink(DefaultClient, source, headers)
+}
+
+func loadMetalink(client *http.Client, source string, headers []string) (*Metalink, error) {
+	var r io.Reader
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequest("GET", source, nil)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		setHeaders(req.Header, headers)
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return nil, newStatusError(resp)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ml, err := ParseMetalink(io.LimitReader(r, maxMetalinkSize))
+	return ml, logex.Trace(err)
+}
+
+func ParseMetalink(r io.Reader) (*Metalink, error) {
+	ml := new(Metalink)
+	if err := xml.NewDecoder(r).Decode(ml); err != nil {
+		return nil, logex.Trace(err)
+	}
+	for _, f := range ml.Files3 {
+		f.Hashes = append(f.Hashes, f.Hashes3...)
+		if f.Pieces == nil {
+			f.Pieces = f.Pieces3
+		}
+		for _, u := range f.Urls3 {
+			// map the preference to priority
+			u.Priority = 101 - u.Preference
+		}
+		f.Urls = append(f.Urls, f.Urls3...)
+	}
+	ml.Files = append(ml.Files, ml.Files3...)
+	ml.Files3 = nil
+	if len(ml.Files) == 0 {
+		return nil, logex.NewError("no file in metalink")
+	}
+	for _, f := range ml.Files {
+		f.Name = strings.TrimSpace(f.Name)
+		for _, u := range f.Urls {
+			u.Url = strings.TrimSpace(u.Url)
+		}
+	}
+	return ml, nil
+}
+
+// Sources returns the urls ordered by priority, the ones at the location
+// go first if they have the same priority.
+func (f *MetalinkFile) Sources(location string) []string {
+	urls := make([]*MetalinkUrl, 0, len(f.Urls))
+	for _, u := range f.Urls {
+		if strings.HasPrefix(u.Url, "http://") || strings.HasPrefix(u.Url, "https://") {
+			urls = append(urls, u)
+		}
+	}
+	priority := func(u *MetalinkUrl) int {
+		if u.Priority <= 0 {
+			return 999999
+		}
+		return u.Priority
+	}
+	sort.SliceStable(urls, func(i, j int) bool {
+		pi, pj := priority(urls[i]), priority(urls[j])
+		if pi != pj {
+			return pi < pj
+		}
+		return location != "" &&
+			strings.EqualFold(urls[i].Location, location) &&
+			!strings.EqualFold(urls[j].Location, location)
+	})
+	ret := make([]string, len(urls))
+	for i, u := range urls {
+		ret[i] = u.Url
+	}
+	return ret
+}
+
+// Checksums returns the supported whole-file hashes.
+func (f *MetalinkFile) Checksums() []*Checksum {
+	var sums []*Checksum
+	for _, h := range f.Hashes {
+		c, err := newChecksum(h.Type, h.Value)
+		if err != nil {
+			logex.Info("ignore metalink hash:", err)
+			continue
+		}
+		sums = append(sums, c)
+	}
+	return sums
+}
+
+func (p *MetalinkPieces) hash() hash.Hash {
+	switch strings.ToLower(strings.Replace(p.Type, "-", "", -1)) {
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	}
+	return nil
+}
+
+// verify the pieces of target, the mismatched ones are marked as
+// STATE_INIT. The length of pieces must be the size of block.
+func (p *MetalinkPieces) verify(m *Meta) (bad []int, err error) {
+	f, err := os.Open(m.dataPath())
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	defer f.Close()
+
+	h := p.hash()
+	buf := make([]byte, p.Length)
+	for i, expect := range p.Hashes {
+		if i >= len(m.Blocks) {
+			break
+		}
+		n, err := f.ReadAt(buf, int64(i)*p.Length)
+		if err != nil && err != io.EOF {
+			return bad, logex.Trace(err)
+		}
+		h.Reset()
+		h.Write(buf[:n])
+		if n == m.blkLen(i) && hex.EncodeToString(h.Sum(nil)) == strings.ToLower(strings.TrimSpace(expect)) {
+			continue
+		}
+		bad = append(bad, i)
+		m.MarkBlockInit(i)
+	}
+	if len(bad) > 0 {
+		if err := m.Sync(); err != nil {
+			return bad, logex.Trace(err)
+		}
+	}
+	return bad, nil
+}
+
+type link struct {
+	Url    string
+	Params map[string]string
+}
+
+// parse the Link header: <url>; rel=duplicate; pri=1, <url>; rel=describedby
+func parseLinks(h http.Header) []*link {
+	var links []*link
+	for _, v := range h[H_LINK] {
+		for v != "" {
+			start := strings.Index(v, "<")
+			end := strings.Index(v, ">")
+			if start < 0 || end < start {
+				break
+			}
+			l := &link{Url: v[start+1 : end], Params: map[string]string{}}
+			v = v[end+1:]
+			next := strings.Index(v, ",")
+			params := v
+			if next >= 0 {
+				params, v = v[:next], v[next+1:]
+			} else {
+				v = ""
+			}
+			for _, p := range strings.Split(params, ";") {
+				if idx := strings.Index(p, "="); idx > 0 {
+					key := strings.ToLower(strings.TrimSpace(p[:idx]))
+					l.Params[key] = strings.Trim(strings.TrimSpace(p[idx+1:]), `"`)
+				}
+			}
+			links = append(links, l)
+		}
+	}
+	return links
+}
+
+// resolveLink returns the absolute url of ref in the Link header of base,
+// empty if it's not http(s), a server must never point to a local file.
+func resolveLink(base *url.URL, ref string) string {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// metalinkLinks returns the metalink described the file and the duplicated
+// sources (RFC 6249) in the Link header, relative to the source.
+func metalinkLinks(source string, h http.Header) (metalink string, duplicates []string) {
+	type dup struct {
+		url string
+		pri int
+	}
+	base, _ := url.Parse(source)
+	var dups []dup
+	for _, l := range parseLinks(h) {
+		u := resolveLink(base, l.Url)
+		if u == "" {
+			continue
+		}
+		switch l.Params["rel"] {
+		case "describedby":
+			if t := l.Params["type"]; t == MIME_METALINK4 || t == MIME_METALINK {
+				metalink = u
+			}
+		case "duplicate":
+			pri, err := strconv.Atoi(l.Params["pri"])
+			if err != nil {
+				pri = 999999
+			}
+			dups = append(dups, dup{u, pri})
+		}
+	}
+	sort.SliceStable(dups, func(i, j int) bool { return dups[i].pri < dups[j].pri })
+	for _, d := range dups {
+		duplicates = append(duplicates, d.url)
+	}
+	return metalink, duplicates
+}
+
+// NewDnTaskMetalink creates a task from the first file in metalink, which
+// is a local file or an url. The file is downloaded from all the sources in
+// it and verified by its hashes.
+func NewDnTaskMetalink(source, pwd string, bit uint, cfg *TaskConfig) (*DnTask, error) {
+	if cfg == nil {
+		cfg = new(TaskConfig)
+	}
+	cfg.init()
+	ml, err := loadMetalink(cfg.Client, source, cfg.Headers)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if len(ml.Files) > 1 {
+		logex.Info("only the first file is downloaded in metalink:", ml.Files[0].Name)
+	}
+	file := ml.Files[0]
+	urls := file.Sources(cfg.Location)
+	if len(urls) == 0 {
+		return nil, logex.NewError("no http source in metalink")
+	}
+
+	c := *cfg
+	if c.Name == "" {
+		c.Name = file.Name
+	}
+	if p := file.Pieces; p != nil && p.Length > 0 && p.Length&(p.Length-1) == 0 {
+		// align the blocks to pieces, so that the pieces can be verified
+		bit = 0
+		for int64(1)<<bit < p.Length {
+			bit++
+		}
+	}
+	return newDnTask(urls, pwd, bit, &c, file)
+}
+
+// apply the sources and hashes of the metalink file to the task
+func (d *DnTask) applyMetalink(f *MetalinkFile) error {
+	if f.Size > 0 && d.Meta.FileSize > 0 && f.Size != d.Meta.FileSize {
+		return logex.NewError("size not matched with metalink:", f.Size, d.Meta.FileSize)
+	}
+	d.checksums = append(d.checksums, f.Checksums()...)
+	if p := f.Pieces; p != nil && len(p.Hashes) > 0 {
+		if p.Length != int64(d.Meta.BlkSize) || p.hash() == nil {
+			logex.Info("ignore pieces in metalink:", p.Type, p.Length)
+		} else {
+			d.pieces = p
+		}
+	}
+	d.addMirrors(f.Sources(d.Location))
+	return nil
+}
+
+// follow the metalink and duplicates in the Link header
+func (d *DnTask) discoverMetalink() {
+	metalink, duplicates := metalinkLinks(d.Meta.Source, d.Meta.header)
+	d.addMirrors(duplicates)
+	if metalink == "" {
+		return
+	}
+	ml, err := loadMetalink(d.Client, metalink, d.Headers)
+	if err != nil {
+		logex.Info("ignore metalink", metalink, "error:", err)
+		return
+	}
+	if err := d.applyMetalink(ml.Files[0]); err != nil {
+		logex.Info("ignore metalink", metalink, "error:", err)
+	}
+}
@@ -0,0 +1,106 @@
+package godl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMetalinkLinks(t *testing.T) {
+	h := make(http.Header)
+	h.Add(H_LINK, `<f.meta4>; rel=describedby; type="application/metalink4+xml"`)
+	h.Add(H_LINK, `<file:///etc/passwd>; rel=duplicate; pri=1, <//mirror.example.com/f>; rel=duplicate; pri=2`)
+	h.Add(H_LINK, `<ftp://example.com/f>; rel=duplicate, </mirror/f>; rel=duplicate; pri=3`)
+	metalink, duplicates := metalinkLinks("http://example.com/dir/f", h)
+	if metalink != "http://example.com/dir/f.meta4" {
+		t.Fatal("unexpected metalink:", metalink)
+	}
+	want := []string{"http://mirror.example.com/f", "http://example.com/mirror/f"}
+	if len(duplicates) != len(want) {
+		t.Fatal("unexpected duplicates:", duplicates)
+	}
+	for i := range want {
+		if duplicates[i] != want[i] {
+			t.Fatal("unexpected duplicates:", duplicates)
+		}
+	}
+}
+
+func newTestMetalink(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="f">
+    <size>` + strconv.Itoa(len(data)) + `</size>
+    <hash type="sha-256">` + hex.EncodeToString(sum[:]) + `</hash>
+  </file>
+</metalink>`)
+}
+
+// newTestLinked serves data at /f with the Link header, and the metalink
+// of data at /f.meta4
+func newTestLinked(t *testing.T, data []byte, link string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/f":
+			w.Header().Set(H_LINK, link)
+			http.ServeContent(w, r, "f", time.Unix(1000, 0), bytes.NewReader(data))
+		case "/f.meta4":
+			w.Write(newTestMetalink(data))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestMetalinkRelativeLink(t *testing.T) {
+	data := bytes.Repeat([]byte("godl"), 1<<12)
+	origin := newTestLinked(t, data, `</f.meta4>; rel=describedby; type="application/metalink4+xml"`)
+	task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = task.Schedule(2)
+	task.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	if len(task.checksums) != 1 || !task.checksums[0].Equal(sum[:]) {
+		t.Fatal("the metalink is not applied:", task.checksums)
+	}
+}
+
+// a server can't make godl read a local file
+func TestMetalinkLocalLink(t *testing.T) {
+	local := filepath.Join(t.TempDir(), "f.meta4")
+	// the hash is not matched
+	if err := ioutil.WriteFile(local, newTestMetalink([]byte("local")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, link := range []string{"file://" + local, local} {
+		data := bytes.Repeat([]byte("godl"), 1<<12)
+		origin := newTestLinked(t, data, "<"+link+`>; rel=describedby; type="application/metalink4+xml"`)
+		task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = task.Schedule(2)
+		task.Close()
+		if err != nil {
+			t.Fatal(link, err)
+		}
+		if len(task.checksums) != 0 {
+			t.Fatal("the local metalink is loaded:", link)
+		}
+	}
+}
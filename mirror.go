@@ -0,0 +1,186 @@
+package godl
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/logex.v1"
+)
+
+// drop a mirror after maxMirrorFailures continuous failures
+const maxMirrorFailures = 3
+
+// Mirror is a source of the file, the blocks are handed out across the
+// mirrors according to their measured speed.
+type Mirror struct {
+	Url string
+
+	written  int64
+	elapsed  int64
+	failures int32
+	dropped  int32
+}
+
+func NewMirror(url string) *Mirror {
+	return &Mirror{Url: url}
+}
+
+// Speed returns the measured bytes per second, 0 if it's not measured.
+func (m *Mirror) Speed() int64 {
+	elapsed := atomic.LoadInt64(&m.elapsed)
+	if elapsed <= 0 {
+		return 0
+	}
+	return atomic.LoadInt64(&m.written) * int64(time.Second) / elapsed
+}
+
+func (m *Mirror) IsDropped() bool {
+	return atomic.LoadInt32(&m.dropped) != 0
+}
+
+func (m *Mirror) record(written int64, d time.Duration) {
+	atomic.AddInt64(&m.written, written)
+	atomic.AddInt64(&m.elapsed, int64(d))
+}
+
+// check the mirror serves the same file as meta
+func (m *Mirror) check(meta *Meta, headers []string) error {
+	req, err := http.NewRequest("HEAD", m.Url, nil)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	setHeaders(req.Header, headers)
+	resp, err := meta.httpClient().Do(req)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return newStatusError(resp)
+	}
+	if resp.ContentLength != meta.FileSize {
+		return logex.NewError("size not matched:", resp.ContentLength, meta.FileSize)
+	}
+	etag := resp.Header.Get(H_ETAG)
+	if etag != "" && meta.Etag != "" && etag != meta.Etag {
+		return logex.NewError("etag not matched:", etag, meta.Etag)
+	}
+	if resp.Header.Get(H_ACCEPT_RANGES) != "bytes" {
+		return logex.NewError("range is not acceptable")
+	}
+	return nil
+}
+
+// the mirrors of a task, the first one is the Meta.Source
+type mirrorSet struct {
+	mirrors []*Mirror
+	sync.Mutex
+}
+
+func newMirrorSet(source string) *mirrorSet {
+	return &mirrorSet{mirrors: []*Mirror{NewMirror(source)}}
+}
+
+// add checks the urls concurrently, and adds the ones serving the same file.
+func (s *mirrorSet) add(meta *Meta, urls []string, headers []string) {
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		if u == "" || u == meta.Source {
+			continue
+		}
+		wg.Add(1)
+		go func(m *Mirror) {
+			defer wg.Done()
+			if err := m.check(meta, headers); err != nil {
+				logex.Info("drop mirror", m.Url, "error:", err)
+				return
+			}
+			s.Lock()
+			s.mirrors = append(s.mirrors, m)
+			s.Unlock()
+		}(NewMirror(u))
+	}
+	wg.Wait()
+}
+
+// pick chooses a mirror, the chance is in proportion to the measured speed.
+// The unmeasured mirrors are taken as the average speed.
+func (s *mirrorSet) pick() *Mirror {
+	s.Lock()
+	defer s.Unlock()
+
+	var (
+		alive    []*Mirror
+		speeds   []int64
+		measured int64
+		sum      int64
+	)
+	for _, m := range s.mirrors {
+		if m.IsDropped() {
+			continue
+		}
+		sp := m.Speed()
+		if sp > 0 {
+			measured++
+			sum += sp
+		}
+		alive = append(alive, m)
+		speeds = append(speeds, sp)
+	}
+	if len(alive) <= 1 {
+		if len(alive) == 0 {
+			return s.mirrors[0]
+		}
+		return alive[0]
+	}
+
+	avg := int64(1)
+	if measured > 0 {
+		avg = sum / measured
+	}
+	var total int64
+	for i, sp := range speeds {
+		if sp == 0 {
+			speeds[i] = avg
+		}
+		total += speeds[i]
+	}
+	n := rand.Int63n(total)
+	for i, sp := range speeds {
+		if n < sp {
+			return alive[i]
+		}
+		n -= sp
+	}
+	return alive[len(alive)-1]
+}
+
+func (s *mirrorSet) succeed(m *Mirror, written int64, d time.Duration) {
+	atomic.StoreInt32(&m.failures, 0)
+	m.record(written, d)
+}
+
+// fail records the failure of m, and returns true if m is dropped. The
+// last alive mirror is never dropped.
+func (s *mirrorSet) fail(m *Mirror, err error) bool {
+	failures := atomic.AddInt32(&m.failures, 1)
+	if !IsPermanent(err) && failures < maxMirrorFailures {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	alive := 0
+	for _, mm := range s.mirrors {
+		if !mm.IsDropped() {
+			alive++
+		}
+	}
+	if alive <= 1 || !atomic.CompareAndSwapInt32(&m.dropped, 0, 1) {
+		return false
+	}
+	logex.Info("drop mirror", m.Url, "error:", err)
+	return true
+}
@@ -0,0 +1,70 @@
+package godl
+
+import (
+	"path/filepath"
+
+	"gopkg.in/logex.v1"
+)
+
+// the strategies to preallocate the target file, see TaskConfig.Prealloc
+const (
+	// the file grows with the writes
+	PREALLOC_NONE = "none"
+	// the file is truncated to the size, the blocks are not allocated
+	PREALLOC_SPARSE = "sparse"
+	// the blocks are allocated by fallocate, it's sparse if unsupported
+	PREALLOC_FALLOCATE = "fallocate"
+)
+
+func checkPrealloc(s string) error {
+	switch s {
+	case "", PREALLOC_NONE, PREALLOC_SPARSE, PREALLOC_FALLOCATE:
+		return nil
+	}
+	return logex.NewError("unknown prealloc:", s)
+}
+
+// SpaceError means the disk can't hold the rest of the file.
+type SpaceError struct {
+	Need int64
+	Free int64
+}
+
+func (e *SpaceError) Error() string {
+	return "not enough space: need " + calUnit(e.Need) + ", free " + calUnit(e.Free)
+}
+
+// preallocate checks the free space and preallocates the target file by
+// the strategy in Prealloc, if the size is known.
+func (d *DnTask) preallocate() error {
+	size := d.Meta.FileSize
+	if size <= 0 {
+		return nil
+	}
+	fi, err := d.file.Stat()
+	if err != nil {
+		return logex.Trace(err)
+	}
+	free, err := diskFree(filepath.Dir(d.file.Name()))
+	if err != nil {
+		return logex.Trace(err)
+	}
+	if need := size - diskUsage(fi); free >= 0 && need > free {
+		return &SpaceError{Need: need, Free: free}
+	}
+
+	switch d.Prealloc {
+	case PREALLOC_FALLOCATE:
+		err = fallocate(d.file, size)
+		if err == nil {
+			return nil
+		}
+		logex.Info("fallocate is unsupported, turn to sparse:", err)
+		fallthrough
+	case PREALLOC_SPARSE:
+		if fi.Size() < size {
+			return logex.Trace(d.file.Truncate(size))
+		}
+	}
+	return nil
+}
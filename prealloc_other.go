@@ -0,0 +1,21 @@
+//go:build !linux
+
+package godl
+
+import (
+	"gopkg.in/logex.v1"
+	"os"
+)
+
+func fallocate(f *os.File, size int64) error {
+	return logex.NewError("fallocate is not supported")
+}
+
+// -1 means unknown, the space is not checked
+func diskFree(dir string) (int64, error) {
+	return -1, nil
+}
+
+func diskUsage(fi os.FileInfo) int64 {
+	return fi.Size()
+}
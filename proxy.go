@@ -1,25 +1,168 @@
-package main
+package godl
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/logex.v1"
 )
 
-func bindHandler(mux *http.ServeMux) {
-	mux.HandleFunc("/proxy", proxyHandler)
+// the signed proxy url is valid in this duration
+const PROXY_SIGN_TTL = 5 * time.Minute
+
+// ProxyServerConfig restricts who can use the /proxy of the godl server and
+// where it can go.
+type ProxyServerConfig struct {
+	// the requests must be signed by the secret if it's not empty,
+	// see proxyUrl
+	Secret string
+	// the destination hosts, domains (.example.com) or CIDRs, see
+	// accessList
+	Allow []string
+	Deny  []string
+	// the requests per second allowed for each client, 0 means unlimited
+	ClientRate float64
+	// the proxy to connect the destinations, see UpstreamProxy. Unlike
+	// DefaultClient, the proxies in the environment are not used.
+	Upstream string
+	// the routes to relay the requests through other godl proxies, the
+	// first matched is used, see RelayRoute
+	Relays []RelayRoute
+	// used to connect the https relays, see NewClientTLSConfig
+	RelayTLS *tls.Config
+	// the ranges are cached in it if it's not nil, see BlockCache
+	Cache *BlockCache
+	// the headers of clients forwarded to the destinations, see H_FORWARD.
+	// DefaultForwardHeaders is used if nil, and "*" allows all. Cookie is
+	// forwarded only if it's listed.
+	ForwardHeaders []string
+}
+
+// the headers forwarded by default, see ProxyServerConfig.ForwardHeaders
+var DefaultForwardHeaders = []string{
+	"Authorization", "User-Agent", "Referer", "Accept", "Accept-Language",
+}
+
+// never forwarded, they are managed by the godl proxy
+var proxyHopHeaders = map[string]bool{
+	"Host": true, "Range": true, "Connection": true, "Keep-Alive": true,
+	"Content-Length": true, "Transfer-Encoding": true, "Te": true,
+	"Trailer": true, "Upgrade": true, "Proxy-Authorization": true,
+	"Proxy-Connection": true, H_FORWARD: true,
+}
+
+type proxyServer struct {
+	secret  string
+	forward map[string]bool
+	limit   *clientLimiter
+	client  *http.Client
+	cache   *BlockCache
+	infos   *sourceInfos
+	access  *accessList
+
+	relays      []RelayRoute
+	relayClient *http.Client
+}
+
+func (p *proxyServer) canForward(name string) bool {
+	if proxyHopHeaders[name] {
+		return false
+	}
+	return p.forward[name] || (p.forward["*"] && name != "Cookie")
+}
+
+// BindHandler registers the proxy handler of the godl server into mux.
+// A nil cfg denies the internal destinations only.
+func BindHandler(mux *http.ServeMux, cfg *ProxyServerConfig) error {
+	if cfg == nil {
+		cfg = new(ProxyServerConfig)
+	}
+	access, err := newAccessList(cfg.Allow, cfg.Deny)
+	if err != nil {
+		return logex.Trace(err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = access.dialContext
+	if cfg.Upstream != "" {
+		upstream, err := UpstreamProxy(cfg.Upstream)
+		if err != nil {
+			return logex.Trace(err)
+		}
+		// the upstream proxy is dialed instead of the destination
+		transport.DialContext = nil
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			if err := access.checkRequest(req); err != nil {
+				return nil, err
+			}
+			return upstream(req)
+		}
+	}
+	forward := cfg.ForwardHeaders
+	if forward == nil {
+		forward = DefaultForwardHeaders
+	}
+	p := &proxyServer{
+		secret:  cfg.Secret,
+		forward: make(map[string]bool, len(forward)),
+		limit:   newClientLimiter(cfg.ClientRate),
+		client:  &http.Client{Transport: transport},
+		cache:   cfg.Cache,
+		infos:   newSourceInfos(),
+		access:  access,
+
+		relays:      cfg.Relays,
+		relayClient: newProxyClient(cfg.RelayTLS),
+	}
+	for _, h := range forward {
+		if h != "*" {
+			h = http.CanonicalHeaderKey(h)
+		}
+		p.forward[h] = true
+	}
+	mux.HandleFunc("/proxy", p.handler)
+	return nil
 }
 
 type ProxyConfig struct {
 	Url   string
 	Start int64
 	End   int64
+	// forwarded to the source
+	Header http.Header
+	// the godl proxies relayed by before
+	Hops int
+	// the If-Range of the client, the source is changed if it's not matched
+	IfRange string
 }
 
-func proxyUrl(host, source string, start, end int64) string {
+// H_FORWARD carries a header forwarded to the source by the godl proxy,
+// like "X-Godl-Header: Authorization: Bearer <token>".
+const H_FORWARD = "X-Godl-Header"
+
+// newProxyRequest returns the request to download source by the godl proxy
+// at host, which is like "[https://][secret@]host:port". The headers are
+// forwarded to the source. If the server requires a secret, the request
+// is signed by it.
+func newProxyRequest(ctx context.Context, method, host, source string, start, end int64, headers []string) (*http.Request, error) {
+	scheme := "http"
+	if idx := strings.Index(host, "://"); idx >= 0 {
+		scheme, host = host[:idx], host[idx+3:]
+	}
+	var secret string
+	if idx := strings.LastIndex(host, "@"); idx >= 0 {
+		secret, host = host[:idx], host[idx+1:]
+	}
 	u := url.Values{
 		"url": {source},
 	}
@@ -29,23 +172,76 @@ func proxyUrl(host, source string, start, end int64) string {
 	if end > 0 {
 		u.Add("end", strconv.FormatInt(end, 10))
 	}
-	return "http://" + host + "/proxy?" + u.Encode()
+	if secret != "" {
+		u.Set("expires", strconv.FormatInt(time.Now().Add(PROXY_SIGN_TTL).Unix(), 10))
+		u.Set("sig", proxySign(u, headers, secret))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, scheme+"://"+host+"/proxy?"+u.Encode(), nil)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	for _, h := range headers {
+		req.Header.Add(H_FORWARD, h)
+	}
+	return req, nil
+}
+
+// proxySign returns the hmac-sha256 of the query without sig and the
+// forwarded headers.
+func proxySign(u url.Values, headers []string, secret string) string {
+	signed := make(url.Values, len(u))
+	for k, v := range u {
+		if k != "sig" {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed.Encode()))
+	for _, h := range headers {
+		mac.Write([]byte("\n" + h))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
 }
 
-func proxyDo(method string, p *ProxyConfig, h http.Header) (io.ReadCloser, int, error) {
-	req, err := http.NewRequest(method, p.Url, nil)
+func (p *proxyServer) checkSign(u url.Values, headers []string) error {
+	if p.secret == "" {
+		return nil
+	}
+	sig := u.Get("sig")
+	if sig == "" || !hmac.Equal([]byte(sig), []byte(proxySign(u, headers, p.secret))) {
+		return logex.NewError("invalid signature")
+	}
+	expires, err := strconv.ParseInt(u.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return logex.NewError("signature expired")
+	}
+	return nil
+}
+
+// newRequest returns the request to the source with the forwarded headers
+func (p *proxyServer) newRequest(method string, cfg *ProxyConfig) (*http.Request, error) {
+	req, err := http.NewRequest(method, cfg.Url, nil)
 	if err != nil {
-		return nil, 400, logex.Trace(err)
+		return nil, logex.Trace(err)
 	}
-	if p.Start >= 0 {
-		setRange(req.Header, p.Start, p.End)
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, logex.NewError("unsupported scheme:", req.URL.Scheme)
 	}
-	resp, err := DefaultClient.Do(req)
+	for k, v := range cfg.Header {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+func (p *proxyServer) do(method string, cfg *ProxyConfig, h http.Header) (io.ReadCloser, int, error) {
+	resp, err := p.send(method, cfg, cfg.Start, cfg.End, cfg.IfRange)
 	if err != nil {
+		if isAccessError(err) {
+			return nil, 403, err
+		}
 		return nil, 400, logex.Trace(err)
 	}
 
-	resp.Header.Set(H_SOURCE, resp.Request.URL.String())
 	for k, v := range resp.Header {
 		for _, vv := range v {
 			h.Add(k, vv)
@@ -59,17 +255,53 @@ func proxyDo(method string, p *ProxyConfig, h http.Header) (io.ReadCloser, int,
 		// panic
 		return resp.Body, resp.StatusCode, nil
 	default:
+		resp.Body.Close()
 		return nil, resp.StatusCode, logex.NewError("remote error:", resp.Status)
 	}
 }
 
-func proxyHandler(w http.ResponseWriter, req *http.Request) {
-	cfg := new(ProxyConfig)
-	cfg.Url = req.FormValue("url")
-	cfg.Start, _ = strconv.ParseInt(req.FormValue("start"), 10, 64)
-	cfg.End, _ = strconv.ParseInt(req.FormValue("end"), 10, 64)
+func (p *proxyServer) handler(w http.ResponseWriter, req *http.Request) {
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	if !p.limit.allow(client) {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "too many requests", 429)
+		return
+	}
+	query := req.URL.Query()
+	forward := req.Header.Values(H_FORWARD)
+	if err := p.checkSign(query, forward); err != nil {
+		http.Error(w, err.Error(), 403)
+		return
+	}
+
+	cfg := &ProxyConfig{Url: query.Get("url"), Start: -1, Header: make(http.Header)}
+	for _, kv := range forward {
+		idx := strings.Index(kv, ":")
+		if idx <= 0 {
+			http.Error(w, "invalid header: "+kv, 400)
+			return
+		}
+		name := http.CanonicalHeaderKey(strings.TrimSpace(kv[:idx]))
+		if !p.canForward(name) {
+			http.Error(w, "header is not allowed: "+name, 403)
+			return
+		}
+		cfg.Header.Add(name, strings.TrimSpace(kv[idx+1:]))
+	}
+	if start := query.Get("start"); start != "" {
+		cfg.Start, _ = strconv.ParseInt(start, 10, 64)
+	}
+	cfg.End, _ = strconv.ParseInt(query.Get("end"), 10, 64)
+	cfg.Hops, _ = strconv.Atoi(req.Header.Get(H_HOPS))
+	cfg.IfRange = req.Header.Get(H_IF_RANGE)
 
-	rc, code, err := proxyDo(req.Method, cfg, w.Header())
+	if p.cache != nil && req.Method == "GET" && cfg.Start >= 0 && p.serveCache(w, cfg) {
+		return
+	}
+	rc, code, err := p.do(req.Method, cfg, w.Header())
 	if err != nil {
 		http.Error(w, err.Error(), code)
 		return
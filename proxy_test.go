@@ -0,0 +1,136 @@
+package godl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestVersioned serves the version of content with its ETag
+func newTestVersioned(t *testing.T, version *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := atomic.LoadInt32(version)
+		w.Header().Set(H_ETAG, `"v`+string(rune('0'+v))+`"`)
+		data := strings.NewReader(strings.Repeat(string(rune('a'+v)), 1<<16))
+		http.ServeContent(w, r, "f", time.Unix(1000, 0), data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestProxyIfRange(t *testing.T) {
+	var version int32 = 1
+	origin := newTestVersioned(t, &version)
+	mux := http.NewServeMux()
+	if err := BindHandler(mux, &ProxyServerConfig{Allow: []string{"127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+
+	task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, &TaskConfig{Proxy: []string{host}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer task.Close()
+
+	get := func(ifRange string) int {
+		req, err := newProxyRequest(context.Background(), "GET", host, origin.URL+"/f", 0, 100, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(H_IF_RANGE, ifRange)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(`"v1"`); code != 206 {
+		t.Fatal("expect 206, got", code)
+	}
+
+	atomic.StoreInt32(&version, 2)
+	if code := get(`"v1"`); code != 200 {
+		t.Fatal("If-Range is not forwarded, got", code)
+	}
+	_, err = task.proxyGet(context.Background(), task.proxyClient, host, &dnBlk{blk: NewBlock()}, nil, 0, 100)
+	if !errors.Is(err, ErrSourceChanged) {
+		t.Fatal("expect ErrSourceChanged, got", err)
+	}
+}
+
+func TestProxySign(t *testing.T) {
+	origin := newTestOrigin(t, []byte(strings.Repeat("godl", 1<<10)), 0)
+	mux := http.NewServeMux()
+	err := BindHandler(mux, &ProxyServerConfig{Secret: "s3cret", Allow: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	host := srv.Listener.Addr().String()
+	source := origin.URL + "/f"
+	headers := []string{"User-Agent: godl"}
+
+	do := func(req *http.Request) int {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	signed := func(secret string) *http.Request {
+		req, err := newProxyRequest(context.Background(), "GET", secret+"@"+host, source, 0, 100, headers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	// modify the query of a signed request
+	tamper := func(key, value string) *http.Request {
+		req := signed("s3cret")
+		q := req.URL.Query()
+		q.Set(key, value)
+		req.URL.RawQuery = q.Encode()
+		return req
+	}
+
+	if code := do(signed("s3cret")); code != 206 {
+		t.Fatal("the signed request is refused:", code)
+	}
+	// the signature expired, though it's signed by the secret
+	u := url.Values{"url": {source}, "start": {"0"}, "end": {"100"}}
+	u.Set("expires", strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10))
+	u.Set("sig", proxySign(u, nil, "s3cret"))
+	expired, _ := http.NewRequest("GET", srv.URL+"/proxy?"+u.Encode(), nil)
+
+	forwarded := signed("s3cret")
+	forwarded.Header.Add(H_FORWARD, "Authorization: Bearer x")
+	unsigned, _ := newProxyRequest(context.Background(), "GET", host, source, 0, 100, nil)
+
+	for name, req := range map[string]*http.Request{
+		"wrong secret":     signed("bad"),
+		"unsigned":         unsigned,
+		"expired":          expired,
+		"tampered url":     tamper("url", origin.URL+"/g"),
+		"tampered start":   tamper("start", "1"),
+		"tampered end":     tamper("end", "4096"),
+		"tampered expires": tamper("expires", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)),
+		"tampered header":  forwarded,
+	} {
+		if code := do(req); code != 403 {
+			t.Fatal(name, "is accepted:", code)
+		}
+	}
+}
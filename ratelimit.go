@@ -1,8 +1,9 @@
-package main
+package godl
 
 import (
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type RateLimit struct {
@@ -19,6 +20,15 @@ func NewRateLimit(max int64) *RateLimit {
 	return r
 }
 
+// SetMax changes the bytes allowed per period, 0 means unlimited.
+func (r *RateLimit) SetMax(max int64) {
+	atomic.StoreInt64(&r.max, max)
+}
+
+func (r *RateLimit) Max() int64 {
+	return atomic.LoadInt64(&r.max)
+}
+
 func (r *RateLimit) Reset() {
 	r.Lock()
 	if atomic.SwapInt64(&r.waiting, 0) != 0 {
@@ -30,7 +40,7 @@ func (r *RateLimit) Reset() {
 
 func (r *RateLimit) Wait() {
 	r.Lock()
-	if atomic.LoadInt64(&r.written) < r.max {
+	if atomic.LoadInt64(&r.written) < r.Max() {
 		r.Unlock()
 		return
 	}
@@ -46,8 +56,69 @@ func (r *RateLimit) Wait() {
 func (r *RateLimit) Process(w int) {
 redo:
 	written := atomic.AddInt64(&r.written, int64(w))
-	if written > r.max {
+	if max := r.Max(); max > 0 && written > max {
 		r.Wait()
 		goto redo
 	}
 }
+
+// clientLimiter limits the requests per second of each client by token
+// buckets, the burst is the same as the rate.
+type clientLimiter struct {
+	rate    float64
+	clients map[string]*tokenBucket
+	sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newClientLimiter(rate float64) *clientLimiter {
+	return &clientLimiter{
+		rate:    rate,
+		clients: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *clientLimiter) allow(client string) bool {
+	if l == nil || l.rate <= 0 {
+		return true
+	}
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	now := time.Now()
+
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.clients[client]
+	if !ok {
+		if len(l.clients) >= 1024 {
+			l.sweep(now, burst)
+		}
+		b = &tokenBucket{tokens: burst, last: now}
+		l.clients[client] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// remove the buckets which are full again
+func (l *clientLimiter) sweep(now time.Time, burst float64) {
+	for client, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= burst {
+			delete(l.clients, client)
+		}
+	}
+}
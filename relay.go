@@ -0,0 +1,122 @@
+package godl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gopkg.in/logex.v1"
+)
+
+// H_HOPS counts the godl proxies a request is relayed by
+const H_HOPS = "X-Godl-Hops"
+
+// the request is refused once it's relayed more than maxRelayHops times,
+// the relays may be configured in a loop
+const maxRelayHops = 8
+
+// RelayRoute relays the requests to the destinations matched by Host
+// through another godl proxy, so the /proxy can be chained.
+type RelayRoute struct {
+	// the destination host or .domain, empty matches all
+	Host string
+	// the godl proxy like "[https://][secret@]host:port", empty means the
+	// destination is connected directly
+	Proxy string
+}
+
+// ParseRelayRoutes parses the routes like "[host=]proxy", the proxy can be
+// "direct" to connect the host directly.
+func ParseRelayRoutes(entries []string) []RelayRoute {
+	routes := make([]RelayRoute, 0, len(entries))
+	for _, e := range entries {
+		var r RelayRoute
+		r.Proxy = e
+		if idx := strings.Index(e, "="); idx >= 0 {
+			r.Host, r.Proxy = strings.TrimPrefix(e[:idx], "*"), e[idx+1:]
+		}
+		if r.Proxy == "direct" {
+			r.Proxy = ""
+		}
+		routes = append(routes, r)
+	}
+	return routes
+}
+
+// relayOf returns the godl proxy of the first route matched, empty if the
+// destination is connected directly.
+func (p *proxyServer) relayOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	for _, r := range p.relays {
+		if r.Host == "" || matchHost([]string{strings.ToLower(r.Host)}, u.Hostname()) {
+			return r.Proxy
+		}
+	}
+	return ""
+}
+
+// send sends the request to the source directly or by the relay, the range
+// is [start, end) if start >= 0, and an open end means to the end of file.
+// The H_SOURCE of the response is set to the final url. ifRange is sent
+// to the source by the relays too, but the ETag of the response should be
+// checked for the caches of them.
+func (p *proxyServer) send(method string, cfg *ProxyConfig, start, end int64, ifRange string) (*http.Response, error) {
+	relay := p.relayOf(cfg.Url)
+	if relay == "" {
+		req, err := p.newRequest(method, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if start >= 0 && end > 0 {
+			setRange(req.Header, start, end)
+		} else if start >= 0 {
+			req.Header.Set(H_RANGE, fmt.Sprintf("bytes=%d-", start))
+		}
+		if ifRange != "" {
+			req.Header.Set(H_IF_RANGE, ifRange)
+		}
+		resp, err := p.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		resp.Header.Set(H_SOURCE, resp.Request.URL.String())
+		return resp, nil
+	}
+
+	if cfg.Hops >= maxRelayHops {
+		return nil, logex.NewError("too many relays, the routes may be in a loop")
+	}
+	// the addresses are checked by the last hop
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	if err := p.access.checkHost(u.Hostname()); err != nil {
+		return nil, err
+	}
+	var headers []string
+	for k, v := range cfg.Header {
+		for _, vv := range v {
+			headers = append(headers, k+": "+vv)
+		}
+	}
+	req, err := newProxyRequest(context.Background(), method, relay, cfg.Url, start, end, headers)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(H_HOPS, strconv.Itoa(cfg.Hops+1))
+	if ifRange != "" {
+		req.Header.Set(H_IF_RANGE, ifRange)
+	}
+	resp, err := p.relayClient.Do(req)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return resp, nil
+}
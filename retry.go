@@ -0,0 +1,173 @@
+package godl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const H_RETRY_AFTER = "Retry-After"
+
+// RetryPolicy decides how many times a block is retried and how long to
+// wait between the retries.
+type RetryPolicy struct {
+	// the max retries of a block or the stream, the connection gives up after
+	MaxRetry int
+	// the delay is doubled for every retry, from MinDelay to MaxDelay
+	MinDelay time.Duration
+	MaxDelay time.Duration
+}
+
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxRetry: 5,
+	MinDelay: 500 * time.Millisecond,
+	MaxDelay: 30 * time.Second,
+}
+
+// Backoff returns the delay before the retry-th retry (from 0), with
+// jitter in [delay/2, delay). The Retry-After from server is honoured.
+func (p *RetryPolicy) Backoff(retry int, err error) time.Duration {
+	// doubled step by step, the shift overflows with a large MinDelay
+	delay := p.MinDelay
+	for i := 0; i < retry && delay > 0 && delay < p.MaxDelay; i++ {
+		if delay > p.MaxDelay/2 {
+			delay = p.MaxDelay
+		} else {
+			delay *= 2
+		}
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+	}
+	var se *StatusError
+	if errors.As(err, &se) && se.RetryAfter > delay {
+		delay = se.RetryAfter
+	}
+	return delay
+}
+
+// wait for d, returns false if ctx is done before
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// StatusError is returned when the server responds with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func newStatusError(resp *http.Response) *StatusError {
+	return &StatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseRetryAfter(resp.Header.Get(H_RETRY_AFTER)),
+	}
+}
+
+func (e *StatusError) Error() string {
+	return "remote error: " + e.Status
+}
+
+// Retry-After: <seconds> or <http-date>
+func parseRetryAfter(s string) time.Duration {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return 0
+	}
+	if sec, err := strconv.Atoi(s); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// IsPermanent reports whether err won't be fixed by retrying, eg. 404, 410,
+// 416 or TLS errors. Timeouts, resets, 5xx, 408 and 429 are transient.
+func IsPermanent(err error) bool {
+	if errors.Is(err, ErrSourceChanged) {
+		return true
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		switch se.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return false
+		}
+		return se.StatusCode >= 400 && se.StatusCode < 500
+	}
+
+	var (
+		unknownAuth x509.UnknownAuthorityError
+		hostname    x509.HostnameError
+		invalid     x509.CertificateInvalidError
+		verify      *tls.CertificateVerificationError
+		record      tls.RecordHeaderError
+	)
+	return errors.As(err, &unknownAuth) ||
+		errors.As(err, &hostname) ||
+		errors.As(err, &invalid) ||
+		errors.As(err, &verify) ||
+		errors.As(err, &record)
+}
+
+// ErrSourceChanged is returned if the file on server is changed while
+// downloading, it's detected by If-Range.
+var ErrSourceChanged = errors.New("the file is changed on server")
+
+// BlockError is the failure of a block which is given up.
+type BlockError struct {
+	Idx        int
+	Start, End int64
+	Err        error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %d [%d, %d): %v", e.Idx, e.Start, e.End, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// ScheduleError is returned by Schedule if the file could not be completed.
+type ScheduleError struct {
+	Written  int64
+	FileSize int64
+	Blocks   []*BlockError
+}
+
+func (e *ScheduleError) Error() string {
+	msg := fmt.Sprintf("download incomplete: %d of %d", e.Written, e.FileSize)
+	if len(e.Blocks) == 0 {
+		return msg
+	}
+	errs := make([]string, len(e.Blocks))
+	for i, b := range e.Blocks {
+		errs[i] = b.Error()
+	}
+	return fmt.Sprintf("%s, %d blocks failed: %s",
+		msg, len(e.Blocks), strings.Join(errs, "; "))
+}
@@ -0,0 +1,34 @@
+package godl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	for _, p := range []*RetryPolicy{
+		DefaultRetryPolicy,
+		{MinDelay: 10 * time.Minute, MaxDelay: time.Hour},
+		{MinDelay: time.Hour, MaxDelay: time.Minute},
+	} {
+		max := p.MinDelay
+		for retry := 0; retry < 64; retry++ {
+			if retry > 0 && max < p.MaxDelay {
+				max *= 2
+			}
+			if max > p.MaxDelay {
+				max = p.MaxDelay
+			}
+			d := p.Backoff(retry, nil)
+			if d < max/2 || d > max {
+				t.Fatal("retry", retry, "of", p.MinDelay, p.MaxDelay, "expect", max, "got", d)
+			}
+		}
+	}
+
+	// Retry-After is honoured
+	d := DefaultRetryPolicy.Backoff(0, &StatusError{StatusCode: 503, RetryAfter: time.Minute})
+	if d != time.Minute {
+		t.Fatal("Retry-After is ignored:", d)
+	}
+}
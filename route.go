@@ -0,0 +1,218 @@
+package godl
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/logex.v1"
+)
+
+const (
+	// a route is down after maxRouteFailures continuous failures, and it's
+	// probed by a transfer again after the delay, which is doubled each
+	// time it's down again
+	maxRouteFailures  = 3
+	routeDownDelay    = 10 * time.Second
+	routeMaxDownDelay = 5 * time.Minute
+)
+
+// DnType is a route to the sources, through a godl proxy or direct if Proxy
+// is empty. The blocks are handed out across the routes according to their
+// measured speed and error rate.
+type DnType struct {
+	Proxy string
+
+	written  int64
+	elapsed  int64
+	latency  int64
+	requests int64
+	errors   int64
+	failures int32
+	downs    int32
+	// unix nano, the route is not used until then
+	downUntil int64
+
+	// the written at the last tick of progress
+	lastWritten int64
+}
+
+func NewDnType(host string) *DnType {
+	return &DnType{Proxy: host}
+}
+
+// Name returns the host of proxy without the secret, or "direct".
+func (t *DnType) Name() string {
+	if t.Proxy == "" {
+		return "direct"
+	}
+	name := t.Proxy
+	if idx := strings.Index(name, "://"); idx >= 0 {
+		name = name[idx+3:]
+	}
+	if idx := strings.LastIndex(name, "@"); idx >= 0 {
+		name = name[idx+1:]
+	}
+	return name
+}
+
+// Speed returns the measured bytes per second, 0 if it's not measured.
+func (t *DnType) Speed() int64 {
+	elapsed := atomic.LoadInt64(&t.elapsed)
+	if elapsed <= 0 {
+		return 0
+	}
+	return atomic.LoadInt64(&t.written) * int64(time.Second) / elapsed
+}
+
+// Latency returns the average time to the first byte of responses.
+func (t *DnType) Latency() time.Duration {
+	succeed := atomic.LoadInt64(&t.requests) - atomic.LoadInt64(&t.errors)
+	if succeed <= 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&t.latency) / succeed)
+}
+
+// ErrorRate returns the ratio of the failed requests.
+func (t *DnType) ErrorRate() float64 {
+	requests := atomic.LoadInt64(&t.requests)
+	if requests == 0 {
+		return 0
+	}
+	return float64(atomic.LoadInt64(&t.errors)) / float64(requests)
+}
+
+func (t *DnType) IsDown() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&t.downUntil)
+}
+
+// the proxies and the direct route of a task
+type routeSet struct {
+	routes []*DnType
+	sync.Mutex
+}
+
+func newRouteSet(proxy []string) *routeSet {
+	s := new(routeSet)
+	for _, p := range proxy {
+		s.routes = append(s.routes, NewDnType(p))
+	}
+	s.routes = append(s.routes, NewDnType(""))
+	return s
+}
+
+// pick chooses a route which is not down, the chance is in proportion to
+// the measured speed and the success rate. The unmeasured routes are taken
+// as the average speed. If all routes are down, the one which is up first
+// is returned.
+func (s *routeSet) pick() *DnType {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.routes) == 1 {
+		return s.routes[0]
+	}
+
+	var (
+		alive    []*DnType
+		speeds   []int64
+		measured int64
+		sum      int64
+	)
+	first := s.routes[0]
+	for _, t := range s.routes {
+		if atomic.LoadInt64(&t.downUntil) < atomic.LoadInt64(&first.downUntil) {
+			first = t
+		}
+		if t.IsDown() {
+			continue
+		}
+		sp := t.Speed()
+		if sp > 0 {
+			measured++
+			sum += sp
+		}
+		alive = append(alive, t)
+		speeds = append(speeds, sp)
+	}
+	if len(alive) == 0 {
+		return first
+	}
+
+	avg := int64(1)
+	if measured > 0 {
+		avg = sum / measured
+	}
+	var total int64
+	for i, sp := range speeds {
+		if sp == 0 {
+			sp = avg
+		}
+		sp = int64(float64(sp) * (1 - alive[i].ErrorRate()))
+		if sp <= 0 {
+			sp = 1
+		}
+		speeds[i] = sp
+		total += sp
+	}
+	n := rand.Int63n(total)
+	for i, sp := range speeds {
+		if n < sp {
+			return alive[i]
+		}
+		n -= sp
+	}
+	return alive[len(alive)-1]
+}
+
+func (s *routeSet) succeed(t *DnType, written int64, d, latency time.Duration) {
+	atomic.AddInt64(&t.requests, 1)
+	atomic.AddInt64(&t.written, written)
+	atomic.AddInt64(&t.elapsed, int64(d))
+	atomic.AddInt64(&t.latency, int64(latency))
+	atomic.StoreInt32(&t.failures, 0)
+	atomic.StoreInt32(&t.downs, 0)
+}
+
+// fail records the failure of t, and returns true if t is down.
+func (s *routeSet) fail(t *DnType, err error) bool {
+	atomic.AddInt64(&t.requests, 1)
+	atomic.AddInt64(&t.errors, 1)
+	if atomic.AddInt32(&t.failures, 1) < maxRouteFailures || len(s.routes) == 1 {
+		return false
+	}
+	atomic.StoreInt32(&t.failures, 0)
+	downs := atomic.AddInt32(&t.downs, 1)
+	delay := routeMaxDownDelay
+	if downs < 16 && routeDownDelay<<uint(downs-1) < delay {
+		delay = routeDownDelay << uint(downs-1)
+	}
+	atomic.StoreInt64(&t.downUntil, time.Now().Add(delay).UnixNano())
+	logex.Info("route", t.Name(), "is down for", delay, "error:", err)
+	return true
+}
+
+// stats returns the speed in the last second, the error rate and the
+// latency of each route, it's called by progress once a second.
+func (s *routeSet) stats() string {
+	if len(s.routes) == 1 {
+		return ""
+	}
+	stats := make([]string, len(s.routes))
+	for i, t := range s.routes {
+		written := atomic.LoadInt64(&t.written)
+		stat := fmt.Sprintf("%v:%v", t.Name(), calUnit(written-t.lastWritten))
+		t.lastWritten = written
+		if t.IsDown() {
+			stat += "(down)"
+		} else if atomic.LoadInt64(&t.requests) > 0 {
+			stat += fmt.Sprintf("(%.0f%%,%v)", t.ErrorRate()*100,
+				t.Latency().Truncate(time.Millisecond))
+		}
+		stats[i] = stat
+	}
+	return strings.Join(stats, " ")
+}
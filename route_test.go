@@ -0,0 +1,162 @@
+package godl
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDnTypeName(t *testing.T) {
+	for _, c := range []struct {
+		proxy string
+		name  string
+	}{
+		{"", "direct"},
+		{"host:8080", "host:8080"},
+		{"secret@host:8080", "host:8080"},
+		{"https://sec@ret@host:8080", "host:8080"},
+	} {
+		if name := NewDnType(c.proxy).Name(); name != c.name {
+			t.Fatal(c.proxy, "expect", c.name, "got", name)
+		}
+	}
+}
+
+func TestRouteDownAndRecover(t *testing.T) {
+	s := newRouteSet([]string{"proxy:8080"})
+	proxy, direct := s.routes[0], s.routes[1]
+	errFail := errors.New("fail")
+
+	for i := 1; i < maxRouteFailures; i++ {
+		if s.fail(proxy, errFail) {
+			t.Fatal("the route is down after", i, "failures")
+		}
+	}
+	if !s.fail(proxy, errFail) || !proxy.IsDown() {
+		t.Fatal("the route is not down")
+	}
+	for i := 0; i < 100; i++ {
+		if s.pick() == proxy {
+			t.Fatal("the route is picked while it's down")
+		}
+	}
+
+	// it's probed again once the delay is passed
+	atomic.StoreInt64(&proxy.downUntil, time.Now().Add(-time.Second).UnixNano())
+	picked := false
+	for i := 0; i < 100 && !picked; i++ {
+		picked = s.pick() == proxy
+	}
+	if !picked {
+		t.Fatal("the route is not probed again")
+	}
+
+	// the delay is doubled if the probe failed
+	for i := 0; i < maxRouteFailures; i++ {
+		s.fail(proxy, errFail)
+	}
+	until := time.Unix(0, atomic.LoadInt64(&proxy.downUntil))
+	if d := time.Until(until); d <= routeDownDelay || d > 2*routeDownDelay {
+		t.Fatal("unexpected delay:", d)
+	}
+
+	// all routes are down, the one up first is picked
+	for i := 0; i < maxRouteFailures; i++ {
+		s.fail(direct, errFail)
+	}
+	if s.pick() != direct {
+		t.Fatal("expect the route up first")
+	}
+
+	// recovered
+	atomic.StoreInt64(&proxy.downUntil, 0)
+	s.succeed(proxy, 1<<20, time.Second, 10*time.Millisecond)
+	if proxy.IsDown() || proxy.downs != 0 || proxy.failures != 0 {
+		t.Fatal("the route is not recovered")
+	}
+	if proxy.Latency() != 10*time.Millisecond {
+		t.Fatal("unexpected latency:", proxy.Latency())
+	}
+}
+
+func TestRouteSingleNeverDown(t *testing.T) {
+	s := newRouteSet(nil)
+	for i := 0; i < 2*maxRouteFailures; i++ {
+		if s.fail(s.routes[0], errors.New("fail")) {
+			t.Fatal("the only route is down")
+		}
+	}
+	if s.pick() != s.routes[0] {
+		t.Fatal("expect the only route")
+	}
+}
+
+func TestRoutePickBySpeed(t *testing.T) {
+	s := newRouteSet([]string{"fast", "flaky"})
+	fast, flaky, direct := s.routes[0], s.routes[1], s.routes[2]
+	s.succeed(fast, 9<<20, time.Second, 0)
+	s.succeed(flaky, 9<<20, time.Second, 0)
+	s.succeed(direct, 1<<20, time.Second, 0)
+	// half of the requests through flaky failed
+	atomic.AddInt64(&flaky.requests, 1)
+	atomic.AddInt64(&flaky.errors, 1)
+
+	count := make(map[*DnType]int)
+	for i := 0; i < 10000; i++ {
+		count[s.pick()]++
+	}
+	// about 9:4.5:1
+	if !(count[fast] > count[flaky] && count[flaky] > count[direct]) {
+		t.Fatal("unexpected distribution:", count[fast], count[flaky], count[direct])
+	}
+	if count[direct] == 0 {
+		t.Fatal("the slow route is never picked")
+	}
+}
+
+// a dead proxy is avoided by its error rate, and the task goes on directly
+func TestRouteDeadProxy(t *testing.T) {
+	data := bytes.Repeat([]byte("godl"), 1<<16)
+	origin := newTestOrigin(t, data, 0)
+	var hits int64
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		http.Error(w, "bad gateway", 502)
+	}))
+	defer dead.Close()
+
+	task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, &TaskConfig{
+		Proxy: []string{dead.Listener.Addr().String()},
+		Retry: &RetryPolicy{MaxRetry: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = task.Schedule(2)
+	task.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(task.Meta.TargetPath())
+	if !bytes.Equal(got, data) {
+		t.Fatal("the file is corrupted")
+	}
+	proxy := task.routes.routes[0]
+	if atomic.LoadInt64(&hits) == 0 || proxy.ErrorRate() != 1 {
+		t.Fatal("the dead proxy is not tried, hits:", hits)
+	}
+	picked := 0
+	for i := 0; i < 1000; i++ {
+		if task.routes.pick() == proxy {
+			picked++
+		}
+	}
+	if picked > 10 {
+		t.Fatal("the dead proxy is picked", picked, "times")
+	}
+}
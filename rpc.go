@@ -0,0 +1,461 @@
+package godl
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/logex.v1"
+)
+
+// BindRpc registers a subset of the aria2 json-rpc interface at /jsonrpc,
+// the gid of aria2 is the id of job. The requests must carry "token:<secret>"
+// as the first param if the secret is not empty.
+func BindRpc(mux *http.ServeMux, m *Manager, secret string) {
+	r := &rpc{m: m, secret: secret}
+	mux.HandleFunc("/jsonrpc", r.handler)
+}
+
+const RPC_VERSION = "1.36.0"
+
+// error codes of json-rpc
+const (
+	RPC_PARSE_ERROR      = -32700
+	RPC_INVALID_REQUEST  = -32600
+	RPC_METHOD_NOT_FOUND = -32601
+	RPC_INVALID_PARAMS   = -32602
+	// the generic error of aria2
+	RPC_ERROR = 1
+)
+
+type rpc struct {
+	m      *Manager
+	secret string
+}
+
+type rpcRequest struct {
+	Version string            `json:"jsonrpc"`
+	Id      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type rpcResponse struct {
+	Version string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+func newRpcError(code int, msg string) *rpcError {
+	return &rpcError{code, msg}
+}
+
+func (r *rpc) handler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(req.Body).Decode(&raw); err != nil {
+		writeJson(w, 200, &rpcResponse{
+			Version: "2.0",
+			Id:      json.RawMessage("null"),
+			Error:   newRpcError(RPC_PARSE_ERROR, err.Error()),
+		})
+		return
+	}
+
+	// batch
+	if len(raw) > 0 && raw[0] == '[' {
+		var reqs []json.RawMessage
+		if err := json.Unmarshal(raw, &reqs); err != nil {
+			writeJson(w, 200, &rpcResponse{
+				Version: "2.0",
+				Id:      json.RawMessage("null"),
+				Error:   newRpcError(RPC_PARSE_ERROR, err.Error()),
+			})
+			return
+		}
+		resps := make([]*rpcResponse, len(reqs))
+		for i := range reqs {
+			resps[i] = r.serve(reqs[i])
+		}
+		writeJson(w, 200, resps)
+		return
+	}
+	writeJson(w, 200, r.serve(raw))
+}
+
+func (r *rpc) serve(raw json.RawMessage) *rpcResponse {
+	resp := &rpcResponse{Version: "2.0", Id: json.RawMessage("null")}
+	var req rpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		resp.Error = newRpcError(RPC_INVALID_REQUEST, err.Error())
+		return resp
+	}
+	if req.Id != nil {
+		resp.Id = req.Id
+	}
+	result, err := r.call(req.Method, req.Params)
+	if err != nil {
+		rerr, ok := err.(*rpcError)
+		if !ok {
+			rerr = newRpcError(RPC_ERROR, err.Error())
+		}
+		resp.Error = rerr
+		return resp
+	}
+	resp.Result = result
+	return resp
+}
+
+func (r *rpc) call(method string, params []json.RawMessage) (interface{}, error) {
+	if method == "system.multicall" {
+		return r.multicall(params)
+	}
+	if r.secret != "" {
+		var token string
+		if len(params) == 0 || json.Unmarshal(params[0], &token) != nil ||
+			subtle.ConstantTimeCompare([]byte(token), []byte("token:"+r.secret)) != 1 {
+			return nil, newRpcError(RPC_ERROR, "Unauthorized")
+		}
+	}
+	if len(params) > 0 {
+		var token string
+		if json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+			params = params[1:]
+		}
+	}
+
+	switch method {
+	case "aria2.addUri":
+		return r.addUri(params)
+	case "aria2.tellStatus":
+		var gid string
+		var keys []string
+		if err := rpcParams(params, 1, &gid, &keys); err != nil {
+			return nil, err
+		}
+		job, err := r.m.Get(gid)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		return r.status(job, keys), nil
+	case "aria2.tellActive":
+		var keys []string
+		if err := rpcParams(params, 0, &keys); err != nil {
+			return nil, err
+		}
+		return r.tellJobs(keys, 0, -1, JOB_ACTIVE), nil
+	case "aria2.tellWaiting", "aria2.tellStopped":
+		var offset, num int
+		var keys []string
+		if err := rpcParams(params, 2, &offset, &num, &keys); err != nil {
+			return nil, err
+		}
+		if method == "aria2.tellWaiting" {
+			return r.tellJobs(keys, offset, num, JOB_QUEUED, JOB_PAUSED), nil
+		}
+		return r.tellJobs(keys, offset, num, JOB_DONE, JOB_FAILED), nil
+	case "aria2.pause", "aria2.forcePause":
+		return r.gidCall(params, r.m.Pause)
+	case "aria2.unpause":
+		return r.gidCall(params, r.m.Resume)
+	case "aria2.remove", "aria2.forceRemove":
+		return r.gidCall(params, r.m.Remove)
+	case "aria2.changeOption":
+		var gid string
+		var opts map[string]interface{}
+		if err := rpcParams(params, 2, &gid, &opts); err != nil {
+			return nil, err
+		}
+		if v, ok := opts["max-download-limit"]; ok {
+			max, err := parseRpcSize(v)
+			if err != nil {
+				return nil, newRpcError(RPC_INVALID_PARAMS, err.Error())
+			}
+			if err := r.m.SetMaxSpeed(gid, max); err != nil {
+				return nil, logex.Trace(err)
+			}
+		}
+		return "OK", nil
+	case "aria2.getGlobalStat":
+		return r.globalStat(), nil
+	case "aria2.getVersion":
+		return map[string]interface{}{
+			"version":         RPC_VERSION,
+			"enabledFeatures": []string{},
+		}, nil
+	default:
+		return nil, newRpcError(RPC_METHOD_NOT_FOUND, "No such method: "+method)
+	}
+}
+
+// params of system.multicall are [[{"methodName":..., "params":[...]}, ...]],
+// the result of each call is wrapped in an array, or an error object.
+func (r *rpc) multicall(params []json.RawMessage) (interface{}, error) {
+	var calls []struct {
+		MethodName string            `json:"methodName"`
+		Params     []json.RawMessage `json:"params"`
+	}
+	if err := rpcParams(params, 1, &calls); err != nil {
+		return nil, err
+	}
+	ret := make([]interface{}, len(calls))
+	for i, c := range calls {
+		if c.MethodName == "system.multicall" {
+			ret[i] = newRpcError(RPC_ERROR, "Recursive system.multicall forbidden.")
+			continue
+		}
+		result, err := r.call(c.MethodName, c.Params)
+		if err != nil {
+			rerr, ok := err.(*rpcError)
+			if !ok {
+				rerr = newRpcError(RPC_ERROR, err.Error())
+			}
+			ret[i] = rerr
+			continue
+		}
+		ret[i] = []interface{}{result}
+	}
+	return ret, nil
+}
+
+// rpcParams decodes params into ptrs, the first `required` ones must exist.
+func rpcParams(params []json.RawMessage, required int, ptrs ...interface{}) error {
+	if len(params) < required {
+		return newRpcError(RPC_INVALID_PARAMS, "Not enough params")
+	}
+	for i := range ptrs {
+		if i >= len(params) {
+			break
+		}
+		if err := json.Unmarshal(params[i], ptrs[i]); err != nil {
+			return newRpcError(RPC_INVALID_PARAMS, err.Error())
+		}
+	}
+	return nil
+}
+
+func (r *rpc) gidCall(params []json.RawMessage, f func(string) error) (interface{}, error) {
+	var gid string
+	if err := rpcParams(params, 1, &gid); err != nil {
+		return nil, err
+	}
+	if err := f(gid); err != nil {
+		return nil, logex.Trace(err)
+	}
+	return gid, nil
+}
+
+func (r *rpc) addUri(params []json.RawMessage) (interface{}, error) {
+	var uris []string
+	var opts map[string]interface{}
+	if err := rpcParams(params, 1, &uris, &opts); err != nil {
+		return nil, err
+	}
+	spec := &JobSpec{Urls: uris}
+	for k, v := range opts {
+		s, _ := v.(string)
+		switch k {
+		case "dir":
+			spec.Dir = s
+		case "out":
+			spec.Name = s
+		case "header":
+			switch h := v.(type) {
+			case string:
+				spec.Headers = append(spec.Headers, h)
+			case []interface{}:
+				for _, hh := range h {
+					if hs, ok := hh.(string); ok {
+						spec.Headers = append(spec.Headers, hs)
+					}
+				}
+			}
+		case "checksum":
+			// sha-256=<hex> in aria2
+			spec.Checksum = strings.Replace(s, "-", "", 1)
+		case "max-download-limit":
+			max, err := parseRpcSize(v)
+			if err != nil {
+				return nil, newRpcError(RPC_INVALID_PARAMS, err.Error())
+			}
+			spec.MaxSpeed = max
+		case "split", "max-connection-per-server":
+			spec.Conn, _ = strconv.Atoi(s)
+		}
+	}
+	if spec.Name != "" {
+		// out is relative to dir, both are checked by Manager.Add
+		spec.Dir = filepath.Join(spec.Dir, filepath.Dir(spec.Name))
+		spec.Name = filepath.Base(spec.Name)
+	}
+	job, err := r.m.Add(spec)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	return job.Id, nil
+}
+
+// parseRpcSize parses the size like "1M", "512K" or 1024.
+func parseRpcSize(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case float64:
+		return int64(n), nil
+	case string:
+		unit := int64(1)
+		switch {
+		case strings.HasSuffix(n, "K"), strings.HasSuffix(n, "k"):
+			unit = 1 << 10
+		case strings.HasSuffix(n, "M"), strings.HasSuffix(n, "m"):
+			unit = 1 << 20
+		}
+		if unit > 1 {
+			n = n[:len(n)-1]
+		}
+		size, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return 0, logex.Trace(err)
+		}
+		return size * unit, nil
+	default:
+		return 0, logex.NewError("invalid size:", v)
+	}
+}
+
+func rpcStatus(state JobState) string {
+	switch state {
+	case JOB_QUEUED:
+		return "waiting"
+	case JOB_DONE:
+		return "complete"
+	case JOB_FAILED:
+		return "error"
+	default:
+		return string(state)
+	}
+}
+
+// the bitfield of aria2, the highest bit of the first byte is the first
+// block, set if the block is finished.
+func rpcBitfield(blocks string) string {
+	bits := make([]byte, (len(blocks)+7)/8)
+	for i := 0; i < len(blocks); i++ {
+		if blocks[i] == '#' {
+			bits[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return hex.EncodeToString(bits)
+}
+
+func (r *rpc) status(job *JobStatus, keys []string) map[string]interface{} {
+	i64 := func(n int64) string {
+		return strconv.FormatInt(n, 10)
+	}
+	path := job.Path
+	if path == "" {
+		path = filepath.Join(job.Dir, job.Name)
+	}
+	uris := make([]map[string]string, len(job.Urls))
+	for i, u := range job.Urls {
+		uris[i] = map[string]string{"uri": u, "status": "used"}
+	}
+	s := map[string]interface{}{
+		"gid":             job.Id,
+		"status":          rpcStatus(job.State),
+		"totalLength":     i64(job.FileSize),
+		"completedLength": i64(job.Written),
+		"uploadLength":    "0",
+		"downloadSpeed":   i64(job.Speed),
+		"uploadSpeed":     "0",
+		"connections":     strconv.Itoa(job.Conn),
+		"dir":             job.Dir,
+		"files": []map[string]interface{}{{
+			"index":           "1",
+			"path":            path,
+			"length":          i64(job.FileSize),
+			"completedLength": i64(job.Written),
+			"selected":        "true",
+			"uris":            uris,
+		}},
+	}
+	if job.Blocks != "" {
+		s["bitfield"] = rpcBitfield(job.Blocks)
+		s["numPieces"] = strconv.Itoa(len(job.Blocks))
+	}
+	if job.State == JOB_FAILED {
+		s["errorCode"] = "1"
+		s["errorMessage"] = job.Error
+	}
+	if len(keys) == 0 {
+		return s
+	}
+	ret := make(map[string]interface{}, len(keys))
+	for _, k := range keys {
+		if v, ok := s[k]; ok {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+func (r *rpc) tellJobs(keys []string, offset, num int, states ...JobState) []map[string]interface{} {
+	ret := []map[string]interface{}{}
+	for _, job := range r.m.Jobs() {
+		for _, state := range states {
+			if job.State == state {
+				ret = append(ret, r.status(job, keys))
+				break
+			}
+		}
+	}
+	// negative offset counts from the end in aria2
+	if offset < 0 {
+		offset += len(ret)
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset > len(ret) {
+		offset = len(ret)
+	}
+	ret = ret[offset:]
+	if num >= 0 && num < len(ret) {
+		ret = ret[:num]
+	}
+	return ret
+}
+
+func (r *rpc) globalStat() map[string]string {
+	var speed int64
+	count := make(map[JobState]int)
+	for _, job := range r.m.Jobs() {
+		speed += job.Speed
+		count[job.State]++
+	}
+	stopped := strconv.Itoa(count[JOB_DONE] + count[JOB_FAILED])
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatInt(speed, 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(count[JOB_ACTIVE]),
+		"numWaiting":      strconv.Itoa(count[JOB_QUEUED] + count[JOB_PAUSED]),
+		"numStopped":      stopped,
+		"numStoppedTotal": stopped,
+	}
+}
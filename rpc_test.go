@@ -0,0 +1,198 @@
+package godl
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testRpc struct {
+	t   *testing.T
+	url string
+}
+
+func newTestRpc(t *testing.T, m *Manager, secret string) *testRpc {
+	mux := http.NewServeMux()
+	BindRpc(mux, m, secret)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return &testRpc{t, srv.URL + "/jsonrpc"}
+}
+
+// call returns the result decoded into ret, or the error of rpc
+func (r *testRpc) call(ret interface{}, method string, params ...interface{}) *rpcError {
+	body, _ := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0", "id": "1", "method": method, "params": params,
+	})
+	resp, err := http.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  *rpcError       `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		r.t.Fatal(err)
+	}
+	if res.Error == nil && ret != nil {
+		if err := json.Unmarshal(res.Result, ret); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	return res.Error
+}
+
+func (r *testRpc) mustCall(ret interface{}, method string, params ...interface{}) {
+	if err := r.call(ret, method, params...); err != nil {
+		r.t.Fatal(method, err.Message)
+	}
+}
+
+func (r *testRpc) waitStatus(gid, status string) map[string]interface{} {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		var s map[string]interface{}
+		r.mustCall(&s, "aria2.tellStatus", gid)
+		if s["status"] == status {
+			return s
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.t.Fatal(gid, "is not", status)
+	return nil
+}
+
+func TestRpcDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("godl"), 1<<18)
+	origin := newTestOrigin(t, data, 20*time.Millisecond)
+	m := newTestManager(t, []string{"127.0.0.1"})
+	r := newTestRpc(t, m, "")
+
+	var gid string
+	r.mustCall(&gid, "aria2.addUri", []string{origin.URL + "/f"}, map[string]interface{}{
+		"out":                "sub/out.bin",
+		"max-download-limit": "256K",
+		"split":              "2",
+	})
+	s := r.waitStatus(gid, "active")
+	if s["connections"] != "2" {
+		t.Fatal("unexpected connections:", s["connections"])
+	}
+
+	var active []map[string]interface{}
+	r.mustCall(&active, "aria2.tellActive", []string{"gid"})
+	if len(active) != 1 || active[0]["gid"] != gid || len(active[0]) != 1 {
+		t.Fatal("unexpected active jobs:", active)
+	}
+
+	var ret string
+	r.mustCall(&ret, "aria2.pause", gid)
+	r.waitStatus(gid, "paused")
+	var waiting []map[string]interface{}
+	r.mustCall(&waiting, "aria2.tellWaiting", 0, 10)
+	if len(waiting) != 1 {
+		t.Fatal("unexpected waiting jobs:", waiting)
+	}
+
+	r.mustCall(&ret, "aria2.changeOption", gid, map[string]interface{}{
+		"max-download-limit": "0",
+	})
+	if job, _ := m.Get(gid); job.MaxSpeed != 0 {
+		t.Fatal("max speed is not changed:", job.MaxSpeed)
+	}
+	r.mustCall(&ret, "aria2.unpause", gid)
+	s = r.waitStatus(gid, "complete")
+	if s["completedLength"] != s["totalLength"] {
+		t.Fatal("unexpected length:", s["completedLength"], s["totalLength"])
+	}
+	file := s["files"].([]interface{})[0].(map[string]interface{})
+	if path := file["path"].(string); !strings.HasSuffix(path, filepath.FromSlash("sub/out.bin")) {
+		t.Fatal("unexpected path:", path)
+	}
+
+	var stat map[string]string
+	r.mustCall(&stat, "aria2.getGlobalStat")
+	if stat["numStopped"] != "1" || stat["numActive"] != "0" {
+		t.Fatal("unexpected stat:", stat)
+	}
+	r.mustCall(&ret, "aria2.remove", gid)
+	if err := r.call(nil, "aria2.tellStatus", gid); err == nil {
+		t.Fatal("the job is not removed")
+	}
+}
+
+func TestRpcRemoveActive(t *testing.T) {
+	origin := newTestOrigin(t, bytes.Repeat([]byte("godl"), 1<<18), 50*time.Millisecond)
+	m := newTestManager(t, []string{"127.0.0.1"})
+	r := newTestRpc(t, m, "")
+
+	var gid string
+	r.mustCall(&gid, "aria2.addUri", []string{origin.URL + "/f"})
+	r.waitStatus(gid, "active")
+	r.mustCall(nil, "aria2.forceRemove", gid)
+	deadline := time.Now().Add(10 * time.Second)
+	for r.call(nil, "aria2.tellStatus", gid) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the job is not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRpcAddUriPath(t *testing.T) {
+	m := newTestManager(t, nil)
+	r := newTestRpc(t, m, "")
+	for _, opts := range []map[string]interface{}{
+		{"dir": "/tmp"},
+		{"dir": "../x"},
+		{"out": "../../x"},
+		{"dir": "a", "out": "../../x"},
+	} {
+		if err := r.call(nil, "aria2.addUri", []string{"http://example.com/f"}, opts); err == nil {
+			t.Fatal("the path is accepted:", opts)
+		}
+	}
+	if err := r.call(nil, "aria2.addUri", []string{"file:///etc/passwd"}); err == nil {
+		t.Fatal("file url is accepted")
+	}
+}
+
+func TestRpcToken(t *testing.T) {
+	m := newTestManager(t, nil)
+	r := newTestRpc(t, m, "s3cret")
+
+	if err := r.call(nil, "aria2.getGlobalStat"); err == nil {
+		t.Fatal("unauthorized call is accepted")
+	}
+	if err := r.call(nil, "aria2.getGlobalStat", "token:bad"); err == nil {
+		t.Fatal("bad token is accepted")
+	}
+	var stat map[string]string
+	r.mustCall(&stat, "aria2.getGlobalStat", "token:s3cret")
+	if stat["numActive"] != "0" {
+		t.Fatal("unexpected stat:", stat)
+	}
+
+	// each call of multicall carries its token
+	var ret []interface{}
+	r.mustCall(&ret, "system.multicall", []map[string]interface{}{
+		{"methodName": "aria2.getVersion", "params": []string{"token:s3cret"}},
+		{"methodName": "aria2.getVersion", "params": []string{"token:bad"}},
+	})
+	if len(ret) != 2 {
+		t.Fatal("unexpected multicall result:", ret)
+	}
+	if _, ok := ret[0].([]interface{}); !ok {
+		t.Fatal("authorized call failed:", ret[0])
+	}
+	if _, ok := ret[1].(map[string]interface{}); !ok {
+		t.Fatal("unauthorized call succeeded:", ret[1])
+	}
+}
@@ -0,0 +1,127 @@
+package godl
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/logex.v1"
+)
+
+const (
+	autoMinConn  = 2
+	autoMaxConn  = 32
+	autoInterval = 3 * time.Second
+	// the throughput is rising if it grows more than 1/autoGrowth
+	autoGrowth = 10
+)
+
+type scaleWorker struct {
+	cancel context.CancelFunc
+	done   <-chan struct{}
+}
+
+func (w *scaleWorker) isDone() bool {
+	select {
+	case <-w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// autoScale starts with autoMinConn connections, adds one while the total
+// throughput keeps rising, and removes one when it levels off or the
+// transfers start failing (including 429/503 from server). It returns when
+// all the connections exit.
+func (d *DnTask) autoScale(ctx context.Context, spawn func(context.Context, int) <-chan struct{}) {
+	var (
+		workers []*scaleWorker
+		started int
+		// the connections not exited, including the removed ones
+		running int
+		exited  = make(chan struct{})
+	)
+	add := func() {
+		wctx, cancel := context.WithCancel(ctx)
+		done := spawn(wctx, started)
+		workers = append(workers, &scaleWorker{cancel, done})
+		started++
+		running++
+		go func() {
+			<-done
+			select {
+			case exited <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}()
+	}
+	remove := func() {
+		if len(workers) <= 1 {
+			return
+		}
+		// the block in progress will be handed out to others
+		workers[len(workers)-1].cancel()
+		workers = workers[:len(workers)-1]
+	}
+
+	for i := 0; i < autoMinConn && i < len(d.Meta.Blocks); i++ {
+		add()
+	}
+	if running == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(autoInterval)
+	defer ticker.Stop()
+	var (
+		lastSpeed   int64
+		lastWritten = atomic.LoadInt64(&d.Meta.written)
+		lastFailure = atomic.LoadInt64(&d.failures)
+		grown       bool
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-exited:
+			if running--; running == 0 {
+				return
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		alive := workers[:0]
+		for _, w := range workers {
+			if !w.isDone() {
+				alive = append(alive, w)
+			}
+		}
+		workers = alive
+		if len(workers) == 0 {
+			// the removed ones are exiting
+			continue
+		}
+
+		written := atomic.LoadInt64(&d.Meta.written)
+		failure := atomic.LoadInt64(&d.failures)
+		speed := (written - lastWritten) * int64(time.Second) / int64(autoInterval)
+		switch {
+		case failure > lastFailure:
+			remove()
+			grown = false
+		case speed > lastSpeed+lastSpeed/autoGrowth:
+			if len(workers) < autoMaxConn && len(workers) < len(d.Meta.Blocks) {
+				add()
+				grown = true
+			}
+		case grown:
+			// the last connection didn't help
+			remove()
+			grown = false
+		}
+		logex.Debug("connections:", len(workers), "speed:", calUnit(speed))
+		lastSpeed, lastWritten, lastFailure = speed, written, failure
+	}
+}
@@ -0,0 +1,90 @@
+package godl
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/logex.v1"
+)
+
+// ResumeParam resumes the streams of the servers without range support by
+// a query parameter of the offset, eg. "?start=1024".
+type ResumeParam struct {
+	// the host or .domain
+	Host  string
+	Param string
+}
+
+// ParseResumeParams parses the entries like "host=param".
+func ParseResumeParams(entries []string) ([]ResumeParam, error) {
+	params := make([]ResumeParam, 0, len(entries))
+	for _, e := range entries {
+		idx := strings.Index(e, "=")
+		if idx <= 0 || idx == len(e)-1 {
+			return nil, logex.NewError("invalid resume param:", e)
+		}
+		params = append(params, ResumeParam{
+			Host:  strings.ToLower(strings.TrimPrefix(e[:idx], "*")),
+			Param: e[idx+1:],
+		})
+	}
+	return params, nil
+}
+
+// the query parameter of the first matched host, empty if none
+func (d *DnTask) resumeParam(host string) string {
+	for _, p := range d.ResumeParams {
+		if matchHost([]string{p.Host}, host) {
+			return p.Param
+		}
+	}
+	return ""
+}
+
+// resumeOffset returns where the stream is resumed from. The stream of
+// unknown size is always restarted, it can't be told whether it's the same.
+func (d *DnTask) resumeOffset() (int64, error) {
+	written := atomic.LoadInt64(&d.Meta.written)
+	if d.Meta.FileSize > 0 || written == 0 {
+		return written, nil
+	}
+	return 0, d.truncate()
+}
+
+// resumeStream asks the server to send the stream from start, by the query
+// parameter in ResumeParams, or by Range though the server doesn't claim
+// to accept it.
+func (d *DnTask) resumeStream(req *http.Request, start int64) {
+	if param := d.resumeParam(req.URL.Hostname()); param != "" {
+		q := req.URL.Query()
+		q.Set(param, strconv.FormatInt(start, 10))
+		req.URL.RawQuery = q.Encode()
+		return
+	}
+	req.Header.Set(H_RANGE, fmt.Sprintf("bytes=%d-", start))
+	if v := d.Meta.ifRange(); v != "" {
+		req.Header.Set(H_IF_RANGE, v)
+	}
+}
+
+// checkResumed returns where the body of a resumed stream starts. If the
+// server sends the whole file, the progress is dropped and it's restarted.
+func (d *DnTask) checkResumed(req *http.Request, resp *http.Response, start int64) (int64, error) {
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+		cr := resp.Header.Get(H_CONTENT_RANGE)
+		if !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", start)) {
+			return 0, logex.NewError("unexpected Content-Range:", cr, start)
+		}
+		return start, nil
+	case req.Header.Get(H_RANGE) == "" &&
+		(resp.ContentLength < 0 || resp.ContentLength == d.Meta.FileSize-start):
+		// resumed by the query parameter
+		return start, nil
+	}
+	logex.Info("the stream can't be resumed, restart from the beginning")
+	return 0, d.truncate()
+}
@@ -0,0 +1,66 @@
+package godl
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the stream is broken once, and resumed by the query parameter
+func TestStreamRetry(t *testing.T) {
+	data := bytes.Repeat([]byte("godl"), 1<<16)
+	var (
+		mutex  sync.Mutex
+		starts []int64
+	)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the range is never accepted
+		w.Header().Set(H_CONTENT_LENGTH, strconv.Itoa(len(data)))
+		if r.Method == "HEAD" || r.Header.Get(H_RANGE) != "" {
+			w.Write(data)
+			return
+		}
+		start, _ := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		mutex.Lock()
+		starts = append(starts, start)
+		broken := len(starts) == 1
+		mutex.Unlock()
+
+		w.Header().Set(H_CONTENT_LENGTH, strconv.FormatInt(int64(len(data))-start, 10))
+		if broken {
+			w.Write(data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(data[start:])
+	}))
+	defer origin.Close()
+
+	task, err := NewDnTask(origin.URL+"/f", t.TempDir(), 12, &TaskConfig{
+		ResumeParams: []ResumeParam{{Host: "127.0.0.1", Param: "start"}},
+		Retry:        &RetryPolicy{MaxRetry: 3, MinDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.Meta.IsAccpetRange() {
+		t.Fatal("the range is accepted")
+	}
+	err = task.Schedule(1)
+	task.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadFile(task.Meta.TargetPath())
+	if !bytes.Equal(got, data) {
+		t.Fatal("the file is corrupted")
+	}
+	if len(starts) != 2 || starts[0] != 0 || starts[1] <= 0 {
+		t.Fatal("the stream is not resumed:", starts)
+	}
+}
@@ -0,0 +1,113 @@
+package godl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/logex.v1"
+)
+
+// NewServerTLSConfig loads the certificate of the godl server. If clientCA
+// is not empty, the clients must present a certificate signed by it.
+func NewServerTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCA != "" {
+		if cfg.ClientCAs, err = loadCertPool(clientCA); err != nil {
+			return nil, logex.Trace(err)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// NewClientTLSConfig returns the config to connect the godl proxies over
+// https. caFile replaces the system roots, certFile and keyFile are the
+// client certificate of mutual tls. pins are the base64 sha256 of the
+// SubjectPublicKeyInfo, like "sha256/<base64>", one of them must match the
+// server certificate. If only pins are given, the chain is not verified so
+// the self-signed certificates can be used.
+func NewClientTLSConfig(caFile, certFile, keyFile string, pins []string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	var err error
+	if caFile != "" {
+		if cfg.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, logex.Trace(err)
+		}
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, logex.Trace(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if len(pins) > 0 {
+		hashes := make([][]byte, len(pins))
+		for i, pin := range pins {
+			hashes[i], err = base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+			if err != nil || len(hashes[i]) != sha256.Size {
+				return nil, logex.NewError("invalid pin:", pin)
+			}
+		}
+		cfg.InsecureSkipVerify = caFile == ""
+		cfg.VerifyConnection = verifyPins(hashes)
+	}
+	return cfg, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, logex.NewError("no certificate found in", file)
+	}
+	return pool, nil
+}
+
+// PinOf returns the pin of the certificate, see NewClientTLSConfig.
+func PinOf(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func verifyPins(pins [][]byte) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return logex.NewError("no certificate presented")
+		}
+		// the leaf only, the chain may be forged if it's not verified
+		sum := sha256.Sum256(cs.PeerCertificates[0].RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, sum[:]) {
+				return nil
+			}
+		}
+		return logex.NewError("certificate is not pinned:", PinOf(cs.PeerCertificates[0]))
+	}
+}
+
+// newProxyClient returns the client to connect the godl proxies.
+func newProxyClient(cfg *tls.Config) *http.Client {
+	if cfg == nil {
+		return DefaultClient
+	}
+	transport := cloneTransport()
+	transport.TLSClientConfig = cfg
+	return &http.Client{Transport: transport}
+}
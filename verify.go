@@ -0,0 +1,70 @@
+package godl
+
+import (
+	"hash/crc32"
+	"io"
+	"os"
+
+	"gopkg.in/logex.v1"
+)
+
+// VerifyBlocks re-hashes the target file against the block hashes in the
+// journal. The corrupted blocks are marked as STATE_INIT and the meta is
+// synced, so that the next run downloads them again. The blocks without
+// hash (written by an older godl) are trusted.
+func (m *Meta) VerifyBlocks() (bad []int, err error) {
+	f, err := os.Open(m.dataPath())
+	if err != nil {
+		return nil, logex.Trace(err)
+	}
+	defer f.Close()
+
+	buf := make([]byte, m.BlkSize)
+	for i, head := range m.Blocks {
+		if head == nil {
+			continue
+		}
+		corrupted := false
+		for _, blk := range head.spans() {
+			if blk.Written == 0 || blk.Hash == 0 {
+				continue
+			}
+			off := int64(i)<<m.BlkBit + int64(blk.Start)
+			n, err := f.ReadAt(buf[:blk.Written], off)
+			if err != nil && err != io.EOF {
+				return bad, logex.Trace(err)
+			}
+			if n == blk.Written && crc32.Checksum(buf[:n], blkHashTable) == blk.Hash {
+				continue
+			}
+			corrupted = true
+			m.MarkSpanInit(blk)
+		}
+		if corrupted {
+			bad = append(bad, i)
+		}
+	}
+	if len(bad) > 0 {
+		if err := m.Sync(); err != nil {
+			return bad, logex.Trace(err)
+		}
+	}
+	return bad, nil
+}
+
+// VerifyMeta loads the meta of the target (or the meta file itself) and
+// verifies the blocks of it. See Meta.VerifyBlocks.
+func VerifyMeta(target string) (*Meta, []int, error) {
+	if !isMetaPath(target) {
+		target += META_EXT
+	}
+	m, err := NewMetaFormFile(target)
+	if err != nil {
+		return nil, nil, logex.Trace(err)
+	}
+	bad, err := m.VerifyBlocks()
+	if m.file != nil {
+		m.Close()
+	}
+	return m, bad, logex.Trace(err)
+}
@@ -1,13 +1,19 @@
-package main
+package godl
 
 import (
+	"errors"
 	"io"
 	"sync/atomic"
 
 	"gopkg.in/logex.v1"
 )
 
-type onWriteFunc func(int64, int) error
+// called with the offset after written and the bytes just written
+type onWriteFunc func(int64, []byte) error
+
+// returned by FileWriter when the rest of the range is stolen by another
+// connection
+var ErrBlkStolen = errors.New("the rest of block is stolen")
 
 type FileWriter struct {
 	Offset  int64
@@ -15,6 +21,8 @@ type FileWriter struct {
 	op      *writeOp
 	onWrite onWriteFunc
 	ch      chan *writeOp
+	// returns the current end of the range, nil means unlimited
+	limit func() int64
 }
 
 func NewFileWriter(task *DnTask, off int64, op *writeOp, ch chan *writeOp, onWrite onWriteFunc) *FileWriter {
@@ -35,6 +43,17 @@ func (w *FileWriter) Write(buf []byte) (int, error) {
 			return 0, nil
 		}
 	}
+	var stolen bool
+	if w.limit != nil {
+		max := w.limit() - w.Offset
+		if max <= 0 {
+			return 0, ErrBlkStolen
+		}
+		if int64(len(buf)) > max {
+			buf = buf[:max]
+			stolen = true
+		}
+	}
 	w.op.Buf = buf
 	w.op.Offset = w.Offset
 	w.ch <- w.op
@@ -43,8 +62,13 @@ func (w *FileWriter) Write(buf []byte) (int, error) {
 	if reply.Err != nil {
 		return reply.N, logex.Trace(reply.Err)
 	}
-	err := w.onWrite(w.Offset, reply.N)
-	return reply.N, logex.Trace(err)
+	if err := w.onWrite(w.Offset, buf[:reply.N]); err != nil {
+		return reply.N, logex.Trace(err)
+	}
+	if stolen {
+		return reply.N, ErrBlkStolen
+	}
+	return reply.N, nil
 }
 
 var report int64
@@ -66,7 +90,7 @@ func (r *Reader) Read(b []byte) (int, error) {
 }
 
 func (r *Reader) Close() error {
-	if rc := r.r.(io.ReadCloser); rc != nil {
+	if rc, ok := r.r.(io.ReadCloser); ok {
 		return rc.Close()
 	}
 	atomic.StoreInt64(&report, 1)